@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// long lived tokens for scripts and integrations. unlike the jwt,
+// they're limited to the scopes the user picked when creating them
+type APIToken struct {
+	ID        uint       `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"createdAt"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// lets AuthMiddleware tell api tokens apart from jwts
+const apiTokenPrefix = "aro_"
+
+// every resource has a read and a write scope, like "weight:read"
+var scopeResources = []string{"weight", "period", "workouts", "food", "meals", "goals"}
+
+func validScope(scope string) bool {
+	resource, action, found := strings.Cut(scope, ":")
+	return found && slices.Contains(scopeResources, resource) &&
+		(action == "read" || action == "write")
+}
+
+func createAPIToken(s *Server, userID uint, name string,
+	scopes []string, expiresAt *time.Time) (APIToken, string, error) {
+	random, _, err := createRandomToken()
+	if err != nil {
+		return APIToken{}, "", err
+	}
+	token := apiTokenPrefix + random
+
+	t := APIToken{Name: name, Scopes: scopes, CreatedAt: time.Now(), ExpiresAt: expiresAt}
+	sql := `
+		insert into APITokens
+		(LastModified, Revoked, UserID, Name, Token, Scopes, CreatedAt, ExpiresAt)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning ID;`
+	err = s.db.QueryRow(s.ctx, sql, t.CreatedAt, false, userID, name,
+		hashToken(token), scopes, t.CreatedAt, expiresAt).Scan(&t.ID)
+	return t, token, err
+}
+
+// find the user the api token belongs to along with the token's scopes
+func authenticateAPIToken(s *Server, token string) (*User, []string, error) {
+	sql := `
+		update APITokens set LastUsed = $1
+		where Token = $2 and Revoked = false and (ExpiresAt is null or ExpiresAt > $1)
+		returning UserID, Scopes;`
+	var userID uint
+	var scopes []string
+	err := s.db.QueryRow(s.ctx, sql, time.Now(), hashToken(token)).Scan(&userID, &scopes)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := getUser(s, "ID", userID)
+	return user, scopes, err
+}
+
+func getAPITokens(s *Server, userID uint) ([]APIToken, error) {
+	scanToken := func(rows pgx.Rows) (APIToken, error) {
+		var t APIToken
+		err := rows.Scan(&t.ID, &t.Name, &t.Scopes, &t.CreatedAt, &t.LastUsed, &t.ExpiresAt)
+		return t, err
+	}
+
+	sql := `
+		select ID, Name, Scopes, CreatedAt, LastUsed, ExpiresAt from APITokens
+		where UserID = $1 and Revoked = false
+		order by CreatedAt desc;`
+	return fetchRows(s, sql, scanToken, userID)
+}
+
+func revokeAPITokens(s *Server, userID uint) error {
+	sql := `
+		update APITokens set Revoked = true, LastModified = $1
+		where UserID = $2 and Revoked = false;`
+	_, err := s.db.Exec(s.ctx, sql, time.Now(), userID)
+	return err
+}
+
+// requests authenticated with a jwt can do anything
+func hasScope(c *gin.Context, scope string) bool {
+	scopes, exists := c.Get("scopes")
+	return !exists || slices.Contains(scopes.([]string), scope)
+}
+
+// only let api tokens through if they have the resource's scope.
+// GET requests need the read scope, everything else the write scope
+func RequireScope(resource string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope := resource + ":write"
+		if c.Request.Method == "GET" {
+			scope = resource + ":read"
+		}
+
+		if !hasScope(c, scope) {
+			c.AbortWithStatusJSON(StatusForbidden, gin.H{"error": "Missing scope " + scope})
+			return
+		}
+		c.Next()
+	}
+}
+
+// keep api tokens away from account management, like creating more tokens
+func SessionOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, exists := c.Get("sessionID"); !exists {
+			c.AbortWithStatusJSON(StatusForbidden, gin.H{"error": "Not allowed with an api token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// api endpoints
+type APITokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays,omitempty"` // never expires when 0
+}
+
+func (s *Server) CreateAPIToken(c *gin.Context) {
+	var req APITokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := c.MustGet("user").(*User)
+
+	if req.Name == "" || len(req.Scopes) == 0 || req.ExpiresInDays < 0 {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validScope(scope) {
+			c.JSON(StatusBadRequest, gin.H{"error": "Invalid scope " + scope})
+			return
+		}
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		expiry := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &expiry
+	}
+
+	apiToken, token, err := createAPIToken(s, user.ID, req.Name, req.Scopes, expiresAt)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't create token"})
+		return
+	}
+
+	// this is the only time the token is shown
+	c.JSON(StatusOK, gin.H{"apiToken": apiToken, "token": token})
+}
+
+func (s *Server) GetAPITokens(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	tokens, err := getAPITokens(s, user.ID)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't get tokens"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"apiTokens": tokens})
+}
+
+func (s *Server) RevokeAPIToken(c *gin.Context) {
+	idStr, exists := c.GetQuery("id")
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if !exists || err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	user := c.MustGet("user").(*User)
+
+	sql := `
+		update APITokens set Revoked = true, LastModified = $1
+		where ID = $2 and UserID = $3;`
+	if _, err := s.db.Exec(s.ctx, sql, time.Now(), id, user.ID); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't revoke token"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -12,73 +16,148 @@ import (
 	"golang.org/x/crypto/argon2"
 )
 
-func createToken(userId string, secret string) (string, error) {
-	expiry := time.Now().AddDate(0, 0, 100) // 100 days out
-	claims := jwt.MapClaims{"sub": userId, "exp": expiry.Unix()}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+const (
+	accessTokenLifetime  = 15 * time.Minute
+	refreshTokenLifetime = 60 * 24 * time.Hour
+)
+
+// create a short lived access token bound to a session
+func createToken(userId string, sessionId string, keys *KeyRing) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"sub": userId,
+		"sid": sessionId,
+		"iat": now.Unix(),
+		"exp": now.Add(accessTokenLifetime).Unix(),
+	}
+	return keys.Sign(claims)
 }
 
-func verifyToken(tokenStr string, secret string) (*jwt.Token, error) {
-	return jwt.Parse(tokenStr, func(t *jwt.Token) (any, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-		}
-		return []byte(secret), nil
-	})
+func verifyToken(tokenStr string, keys *KeyRing) (*jwt.Token, error) {
+	return keys.Verify(tokenStr)
+}
+
+// create an opaque random token along with the hash we store in the database
+func createRandomToken() (string, string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(bytes)
+	return token, hashToken(token), nil
+}
+
+// the tokens are already random, so a fast hash is enough
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
+// cost parameters for argon2id
+type Argon2Params struct {
+	Time      uint32
+	Memory    uint32 // in KiB
+	Threads   uint8
+	KeyLength uint32
+}
+
+var defaultArgon2Params = Argon2Params{Time: 2, Memory: 64 * 1024, Threads: 4, KeyLength: 64}
+
 // hash a password and return the hash in the password hashing competition format
-func hashPassword(password string) (string, error) {
+func hashPassword(password string, params Argon2Params) (string, error) {
 	salt := make([]byte, 32)
 	if _, err := rand.Read(salt); err != nil {
 		return "", err
 	}
 	encodedSalt := base64.RawStdEncoding.EncodeToString(salt)
 
-	var threads uint8 = 4
-	var time, memory, size uint32 = 2, 64 * 1024, 64
-	key := argon2.IDKey([]byte(password), salt, time, memory, threads, size)
+	key := argon2.IDKey([]byte(password), salt,
+		params.Time, params.Memory, params.Threads, params.KeyLength)
 	hash := base64.RawStdEncoding.EncodeToString(key)
 
 	return fmt.Sprintf(
-		"$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s",
-		memory, time, threads, encodedSalt, hash), nil
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		params.Memory, params.Time, params.Threads, encodedSalt, hash), nil
 }
 
-// check if the hash of the password is the same as an existing password hash
-func verifyPassword(password string, hashStr string) (bool, error) {
-	parts := strings.Split(hashStr, "$")[1:]
-	if parts[0] != "argon2id" && parts[1] != "19" {
-		return false, fmt.Errorf("unsupported algorithm")
+var errMalformedHash = errors.New("malformed password hash")
+
+// parse a hash in the format "$argon2id$v=19$m=65536,t=2,p=4$<salt>$<key>"
+func parsePasswordHash(hashStr string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+
+	parts := strings.Split(hashStr, "$")
+	if len(parts) != 6 || parts[0] != "" {
+		return params, nil, nil, errMalformedHash
+	}
+	if parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return params, nil, nil, fmt.Errorf("unsupported algorithm")
 	}
 
-	var threads uint8
-	var memory, time uint32
+	seen := map[string]bool{}
+	for _, p := range strings.Split(parts[3], ",") {
+		key, value, found := strings.Cut(p, "=")
+		if !found || seen[key] {
+			return params, nil, nil, errMalformedHash
+		}
+		seen[key] = true
 
-	for _, p := range strings.Split(parts[2], ",") {
-		kv := strings.Split(p, "=")
-		val, err := strconv.ParseUint(kv[1], 10, 32)
+		bits := 32
+		if key == "p" {
+			bits = 8
+		}
+		val, err := strconv.ParseUint(value, 10, bits)
 		if err != nil {
-			return false, err
+			return params, nil, nil, errMalformedHash
 		}
-		switch kv[0] {
+
+		switch key {
 		case "m":
-			memory = uint32(val)
+			params.Memory = uint32(val)
 		case "t":
-			time = uint32(val)
+			params.Time = uint32(val)
 		case "p":
-			threads = uint8(val)
+			params.Threads = uint8(val)
+		default:
+			return params, nil, nil, errMalformedHash
 		}
 	}
+	if len(seen) != 3 || params.Time == 0 || params.Threads == 0 {
+		return params, nil, nil, errMalformedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) == 0 {
+		return params, nil, nil, errMalformedHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errMalformedHash
+	}
+	params.KeyLength = uint32(len(key))
 
-	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	return params, salt, key, nil
+}
+
+// check if the hash of the password is the same as an existing password hash
+func verifyPassword(password string, hashStr string) (bool, error) {
+	params, salt, expected, err := parsePasswordHash(hashStr)
 	if err != nil {
 		return false, err
 	}
 
-	key := argon2.IDKey([]byte(password), salt, time, memory, threads, 64)
-	hash := base64.RawStdEncoding.EncodeToString(key)
+	key := argon2.IDKey([]byte(password), salt,
+		params.Time, params.Memory, params.Threads, params.KeyLength)
+	return subtle.ConstantTimeCompare(key, expected) == 1, nil
+}
 
-	return hash == parts[4], nil
+// check if the hash was made with weaker parameters than the ones we use now
+func needsRehash(hashStr string, params Argon2Params) bool {
+	current, _, _, err := parsePasswordHash(hashStr)
+	if err != nil {
+		return true
+	}
+	return current.Time < params.Time || current.Memory < params.Memory ||
+		current.Threads < params.Threads || current.KeyLength < params.KeyLength
 }
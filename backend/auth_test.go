@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestParsePasswordHash(t *testing.T) {
+	params := Argon2Params{Time: 1, Memory: 64, Threads: 1, KeyLength: 32}
+	hash, err := hashPassword("password", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, salt, key, err := parsePasswordHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != params || len(salt) != 32 || len(key) != 32 {
+		t.Errorf("got %+v with a %d byte salt and %d byte key", parsed, len(salt), len(key))
+	}
+
+	version := fmt.Sprintf("v=%d", argon2.Version)
+	malformed := []string{
+		"",
+		"argon2id",
+		"$argon2id$" + version + "$m=64,t=1,p=1$c2FsdA",
+		"$argon2i$" + version + "$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=1$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$" + version + "$m=64,t=1$c2FsdA$a2V5",         // missing one
+		"$argon2id$" + version + "$m=64,t=1,p=1,p=1$c2FsdA$a2V5", // repeated
+		"$argon2id$" + version + "$m=64,t=1,x=1$c2FsdA$a2V5",     // unknown
+		"$argon2id$" + version + "$m=64,t=0,p=1$c2FsdA$a2V5",     // no passes
+		"$argon2id$" + version + "$m=64,t=1,p=0$c2FsdA$a2V5",     // zero threads
+		"$argon2id$" + version + "$m=64,t=1,p=256$c2FsdA$a2V5",   // too many threads
+		"$argon2id$" + version + "$m=4294967296,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$" + version + "$m=-1,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$" + version + "$m=64,t=1,p=1$not base64!$a2V5",
+		"$argon2id$" + version + "$m=64,t=1,p=1$c2FsdA$",
+		"$argon2id$" + version + "$m=64,t=1,p=1$$a2V5",
+	}
+	for _, hash := range malformed {
+		if _, _, _, err := parsePasswordHash(hash); err == nil {
+			t.Errorf("%q: parsed a malformed hash", hash)
+		}
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	params := Argon2Params{Time: 1, Memory: 64, Threads: 1, KeyLength: 32}
+	hash, err := hashPassword("password", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		password string
+		correct  bool
+	}{
+		{"password", true},
+		{"Password", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		correct, err := verifyPassword(test.password, hash)
+		if err != nil || correct != test.correct {
+			t.Errorf("%q: got %v %v, want %v", test.password, correct, err, test.correct)
+		}
+	}
+}
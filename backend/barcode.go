@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// check that the barcode is a UPC-A, EAN-8, EAN-13 or GTIN-14 with a valid
+// check digit, and turn it into a GTIN-14 so every form of the same
+// product's barcode is stored the same way
+func normalizeBarcode(code string) (string, bool) {
+	code = strings.NewReplacer(" ", "", "-", "").Replace(code)
+	if len(code) != 8 && len(code) != 12 && len(code) != 13 && len(code) != 14 {
+		return "", false
+	}
+	for _, digit := range code {
+		if digit < '0' || digit > '9' {
+			return "", false
+		}
+	}
+
+	// weights alternate 3, 1, 3, ... starting from the digit
+	// right before the check digit
+	sum := 0
+	for i := len(code) - 2; i >= 0; i-- {
+		digit := int(code[i] - '0')
+		if (len(code)-2-i)%2 == 0 {
+			digit *= 3
+		}
+		sum += digit
+	}
+	if (10-sum%10)%10 != int(code[len(code)-1]-'0') {
+		return "", false
+	}
+
+	return fmt.Sprintf("%014s", code), true
+}
+
+func getFoodByBarcode(s *Server, barcode string, userID uint) (*Food, error) {
+	// prefer the user's own version of the product
+	sql := fmt.Sprintf(`
+		select %s from Foods
+		where Barcode = $1 and Latest = true and Deleted = false and %s
+		order by Foods.UserID = $2 desc nulls last, Foods.ID limit 1;`,
+		foodColumns, visibleFoods(2))
+	foods, err := fetchRows(s, sql, scanFood, barcode, userID)
+	if err != nil || len(foods) == 0 {
+		return nil, err
+	}
+	return &foods[0], nil
+}
+
+// ask the provider about barcodes we haven't seen yet and cache the answer
+func lookupBarcode(s *Server, barcode string, userID uint) (*Food, error) {
+	food, err := getFoodByBarcode(s, barcode, userID)
+	if food != nil || err != nil || s.foods == nil {
+		return food, err
+	}
+
+	// providers know products by their EAN-13, or EAN-8 for small packages
+	code := barcode
+	if strings.HasPrefix(code, "000000") {
+		code = code[6:]
+	} else if strings.HasPrefix(code, "0") {
+		code = code[1:]
+	}
+	food, err = s.foods.Barcode(code)
+	if food == nil || err != nil {
+		return nil, err
+	}
+
+	food.Barcode = barcode
+	if err := cacheFood(s, food); err != nil {
+		return nil, err
+	}
+	return food, nil
+}
+
+// api endpoints
+func (s *Server) FindFoodByBarcode(c *gin.Context) {
+	code, exists := c.GetQuery("barcode")
+	barcode, valid := normalizeBarcode(code)
+	if !exists || !valid {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid barcode"})
+		return
+	}
+
+	user := c.MustGet("user").(*User)
+
+	food, err := lookupBarcode(s, barcode, user.ID)
+	if err != nil {
+		log.Printf("barcode lookup for %s: %v", barcode, err)
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't look up barcode"})
+		return
+	}
+	if food == nil {
+		c.JSON(StatusBadRequest, gin.H{"error": "Food not found"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"food": food})
+}
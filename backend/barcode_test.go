@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestNormalizeBarcode(t *testing.T) {
+	tests := []struct {
+		code       string
+		normalized string
+		ok         bool
+	}{
+		{"3017620422003", "03017620422003", true},   // ean-13
+		{"036000291452", "00036000291452", true},    // upc-a
+		{"96385074", "00000096385074", true},        // ean-8
+		{"10012345678902", "10012345678902", true},  // gtin-14
+		{"3017 6204-22003", "03017620422003", true}, // as printed
+		{"03017620422003", "03017620422003", true},  // already normalized
+		{"3017620422004", "", false},                // wrong check digit
+		{"301762042200", "", false},                 // digit missing
+		{"12345", "", false},
+		{"30176204220O3", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		normalized, ok := normalizeBarcode(test.code)
+		if normalized != test.normalized || ok != test.ok {
+			t.Errorf("%q: got %q %v, want %q %v",
+				test.code, normalized, ok, test.normalized, test.ok)
+		}
+	}
+}
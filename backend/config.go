@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// optional settings read from the environment
+type Config struct {
+	JWTSecret          string
+	JWTPreviousSecrets []string // still accepted, but no longer used to sign
+	JWTSigningKey      string   // path to an Ed25519 or RSA private key
+	JWTVerifyKeys      []string // paths to keys that are still accepted
+
+	AppURL               string
+	RequireVerifiedEmail bool
+
+	Mailer       string // "smtp" or "log"
+	MailFrom     string
+	MailLogFile  string
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+
+	RateLimitStore   string // "memory" or "postgres"
+	IPRateLimit      int    // requests per minute
+	IPRateBurst      int
+	AccountRateLimit int // login attempts per minute
+	AccountRateBurst int
+	LockoutThreshold int // failed logins before the account gets locked
+
+	Argon2 Argon2Params
+
+	OIDCProviders []OIDCProviderConfig
+
+	DeletionGracePeriod time.Duration // before deleted accounts get purged
+	DeletionJobInterval time.Duration
+
+	FoodProvider           string // "openfoodfacts", "fixtures" or "none"
+	OpenFoodFactsURL       string
+	OpenFoodFactsUserAgent string
+	FoodFixturesDir        string
+}
+
+type OIDCProviderConfig struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string // empty for public clients
+	RedirectURL  string
+}
+
+func loadConfig() (Config, error) {
+	argon2, err := loadArgon2Params()
+	if err != nil {
+		return Config{}, err
+	}
+
+	config := Config{
+		JWTSecret:          os.Getenv("JWT_SECRET"),
+		JWTPreviousSecrets: envList("JWT_PREVIOUS_SECRETS"),
+		JWTSigningKey:      os.Getenv("JWT_SIGNING_KEY"),
+		JWTVerifyKeys:      envList("JWT_VERIFY_KEYS"),
+
+		AppURL:               os.Getenv("APP_URL"),
+		RequireVerifiedEmail: envBool("REQUIRE_VERIFIED_EMAIL", false),
+
+		Mailer:       envString("MAILER", "log"),
+		MailFrom:     envString("MAIL_FROM", "aro <noreply@localhost>"),
+		MailLogFile:  os.Getenv("MAIL_LOG_FILE"),
+		SMTPHost:     os.Getenv("SMTP_HOST"),
+		SMTPPort:     envString("SMTP_PORT", "587"),
+		SMTPUsername: os.Getenv("SMTP_USERNAME"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+
+		RateLimitStore:   envString("RATE_LIMIT_STORE", "memory"),
+		IPRateLimit:      envInt("IP_RATE_LIMIT", 20),
+		IPRateBurst:      envInt("IP_RATE_BURST", 10),
+		AccountRateLimit: envInt("ACCOUNT_RATE_LIMIT", 5),
+		AccountRateBurst: envInt("ACCOUNT_RATE_BURST", 5),
+		LockoutThreshold: envInt("LOCKOUT_THRESHOLD", 10),
+
+		Argon2: argon2,
+
+		OIDCProviders: loadOIDCProviders(),
+
+		DeletionGracePeriod: envDuration("DELETION_GRACE_PERIOD", 14*24*time.Hour),
+		DeletionJobInterval: envDuration("DELETION_JOB_INTERVAL", time.Hour),
+
+		FoodProvider:           envString("FOOD_PROVIDER", "none"),
+		OpenFoodFactsURL:       envString("OPENFOODFACTS_URL", "https://world.openfoodfacts.org"),
+		OpenFoodFactsUserAgent: envString("OPENFOODFACTS_USER_AGENT", "aro/1.0"),
+		FoodFixturesDir:        envString("FOOD_FIXTURES_DIR", "fixtures/openfoodfacts"),
+	}
+
+	// the deletion job ticks on this interval, which has to be positive
+	if config.DeletionJobInterval <= 0 {
+		return Config{}, fmt.Errorf("DELETION_JOB_INTERVAL must be positive, got %s",
+			config.DeletionJobInterval)
+	}
+	return config, nil
+}
+
+// checked before they're narrowed, since a thread count of 256 would
+// otherwise wrap around to 0 and make hashing panic
+func loadArgon2Params() (Argon2Params, error) {
+	passes := envInt("ARGON2_TIME", int(defaultArgon2Params.Time))
+	memory := envInt("ARGON2_MEMORY", int(defaultArgon2Params.Memory))
+	threads := envInt("ARGON2_THREADS", int(defaultArgon2Params.Threads))
+
+	if passes < 1 || passes > math.MaxUint32 {
+		return Argon2Params{}, fmt.Errorf("ARGON2_TIME must be between 1 and %d", uint32(math.MaxUint32))
+	}
+	if threads < 1 || threads > math.MaxUint8 {
+		return Argon2Params{}, fmt.Errorf("ARGON2_THREADS must be between 1 and %d", math.MaxUint8)
+	}
+	// argon2 needs at least 8 KiB for each thread
+	if memory < 8*threads || memory > math.MaxUint32 {
+		return Argon2Params{}, fmt.Errorf(
+			"ARGON2_MEMORY must be between %d (8 KiB per thread) and %d",
+			8*threads, uint32(math.MaxUint32))
+	}
+
+	return Argon2Params{
+		Time:      uint32(passes),
+		Memory:    uint32(memory),
+		Threads:   uint8(threads),
+		KeyLength: defaultArgon2Params.KeyLength,
+	}, nil
+}
+
+// every provider listed in OIDC_PROVIDERS has its settings
+// in OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID and so on
+func loadOIDCProviders() []OIDCProviderConfig {
+	providers := []OIDCProviderConfig{}
+	for _, name := range envList("OIDC_PROVIDERS") {
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		providers = append(providers, OIDCProviderConfig{
+			Name:         strings.ToLower(name),
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+		})
+	}
+	return providers
+}
+
+func envString(name string, fallback string) string {
+	if value, exists := os.LookupEnv(name); exists && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// comma separated list
+func envList(name string) []string {
+	values := []string{}
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func envBool(name string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestLoadArgon2Params(t *testing.T) {
+	tests := []struct {
+		time, memory, threads string
+		ok                    bool
+	}{
+		{"", "", "", true}, // the defaults
+		{"3", "32768", "2", true},
+		{"1", "8", "1", true},
+		{"0", "65536", "4", false},
+		{"-1", "65536", "4", false},
+		{"4294967296", "65536", "4", false},
+		{"2", "65536", "0", false},
+		{"2", "65536", "255", true},
+		{"2", "65536", "256", false},
+		{"2", "31", "4", false}, // less than 8 KiB per thread
+		{"2", "-65536", "4", false},
+		{"2", "4294967296", "4", false},
+	}
+
+	for _, test := range tests {
+		t.Setenv("ARGON2_TIME", test.time)
+		t.Setenv("ARGON2_MEMORY", test.memory)
+		t.Setenv("ARGON2_THREADS", test.threads)
+
+		params, err := loadArgon2Params()
+		if (err == nil) != test.ok {
+			t.Errorf("t=%s m=%s p=%s: got %+v %v", test.time, test.memory, test.threads, params, err)
+		}
+	}
+}
+
+func TestLoadConfigDeletionJobInterval(t *testing.T) {
+	tests := []struct {
+		interval string
+		ok       bool
+	}{
+		{"", true}, // an hour by default
+		{"30m", true},
+		{"0s", false},
+		{"-1h", false},
+	}
+
+	for _, test := range tests {
+		t.Setenv("DELETION_JOB_INTERVAL", test.interval)
+		if _, err := loadConfig(); (err == nil) != test.ok {
+			t.Errorf("%q: got %v", test.interval, err)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// deleting an account only schedules it to be purged once the grace period
+// is over, until then the user can change their mind. the request outlives
+// the account, so the user can check on it with the receipt they were given
+type DeletionRequest struct {
+	Status      string     `json:"status"` // pending, cancelled or completed
+	RequestedAt time.Time  `json:"requestedAt"`
+	PurgeAfter  time.Time  `json:"purgeAfter"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+}
+
+func scheduleDeletion(s *Server, user *User) (DeletionRequest, string, error) {
+	receipt, hash, err := createRandomToken()
+	if err != nil {
+		return DeletionRequest{}, "", err
+	}
+
+	now := time.Now()
+	request := DeletionRequest{
+		Status: "pending", RequestedAt: now,
+		PurgeAfter: now.Add(s.config.DeletionGracePeriod),
+	}
+
+	sql := `
+		insert into DeletionRequests
+		(LastModified, UserID, Email, Receipt, Status, RequestedAt, PurgeAfter)
+		values ($1, $2, $3, $4, $5, $6, $7);`
+	_, err = s.db.Exec(s.ctx, sql, now, user.ID, user.Email, hash,
+		request.Status, request.RequestedAt, request.PurgeAfter)
+	return request, receipt, err
+}
+
+func getPendingDeletion(s *Server, userID uint) (*DeletionRequest, error) {
+	sql := `
+		select Status, RequestedAt, PurgeAfter from DeletionRequests
+		where UserID = $1 and Status = 'pending';`
+	var r DeletionRequest
+	err := s.db.QueryRow(s.ctx, sql, userID).Scan(&r.Status, &r.RequestedAt, &r.PurgeAfter)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return &r, err
+}
+
+// every table holding the user's data, children before their parents
+var userDataQueries = []string{
+	"delete from Exercises where WorkoutID in (select ID from Workouts where UserID = $1);",
+	"delete from Workouts where UserID = $1;",
+	"delete from Records where UserID = $1;",
+	"delete from Meals where UserID = $1;",
+	"delete from DailyFoodLogs where UserID = $1;",
+	"delete from NutritionGoals where UserID = $1;",
+	"delete from RecipeIngredients where RecipeID in (select ID from Recipes where UserID = $1);",
+	"delete from Recipes where UserID = $1;",
+	"delete from ScheduledMealFoods where UserID = $1;",
+	// shared foods stay around for the meals of other users
+	"delete from FoodNutrients where FoodID in (select ID from Foods where UserID = $1 and Shared = false);",
+	"delete from FoodPortions where FoodID in (select ID from Foods where UserID = $1 and Shared = false);",
+	"delete from Foods where UserID = $1 and Shared = false;",
+	"update Foods set UserID = null where UserID = $1;",
+	"delete from Sessions where UserID = $1;",
+	"delete from APITokens where UserID = $1;",
+	"delete from EmailTokens where UserID = $1;",
+	"delete from RecoveryCodes where UserID = $1;",
+	"delete from Identities where UserID = $1;",
+	"delete from OIDCStates where UserID = $1;",
+	"delete from LoginFailures where Email = (select lower(trim(Email)) from Users where ID = $1);",
+	"delete from Users where ID = $1;",
+}
+
+// physically remove everything tied to the user, all or nothing
+func purgeUser(s *Server, tx pgx.Tx, userID uint) error {
+	for _, sql := range userDataQueries {
+		if _, err := tx.Exec(s.ctx, sql, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purge the next account whose grace period is over. returns false when
+// there's nothing left to purge. skip locked lets replicas share the work
+func purgeNextUser(s *Server) (bool, error) {
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(s.ctx)
+
+	var requestID, userID uint
+	var email string
+	sql := `
+		select ID, UserID, Email from DeletionRequests
+		where Status = 'pending' and PurgeAfter <= $1
+		order by PurgeAfter limit 1
+		for update skip locked;`
+	err = tx.QueryRow(s.ctx, sql, time.Now()).Scan(&requestID, &userID, &email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if err := purgeUser(s, tx, userID); err != nil {
+		return false, fmt.Errorf("purging user %d: %w", userID, err)
+	}
+
+	// the email is only kept around long enough to confirm the deletion
+	sql = `
+		update DeletionRequests
+		set Status = 'completed', CompletedAt = $1, LastModified = $1, Email = ''
+		where ID = $2;`
+	if _, err := tx.Exec(s.ctx, sql, time.Now(), requestID); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(s.ctx); err != nil {
+		return false, err
+	}
+
+	body := "Your aro account and all of its data have been permanently deleted.\n"
+	if err := s.mailer.Send(email, "Your aro account was deleted", body); err != nil {
+		log.Printf("couldn't send deletion confirmation: %v", err)
+	}
+	return true, nil
+}
+
+// background job that purges accounts once their grace period is over
+func (s *Server) RunDeletionJob() {
+	ticker := time.NewTicker(s.config.DeletionJobInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			purged, err := purgeNextUser(s)
+			if err != nil {
+				log.Printf("account deletion job: %v", err)
+			}
+			if err != nil || !purged {
+				break
+			}
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// api endpoints
+func (s *Server) DeleteUser(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	pending, err := getPendingDeletion(s, user.ID)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't query database"})
+		return
+	}
+	if pending != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": "Deletion already scheduled"})
+		return
+	}
+
+	request, receipt, err := scheduleDeletion(s, user)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't schedule deletion"})
+		return
+	}
+
+	body := fmt.Sprintf(
+		"Your aro account will be permanently deleted after %s.\n\n"+
+			"Changed your mind? Log in and cancel the deletion before then.\n",
+		request.PurgeAfter.Format(time.RFC1123))
+	if err := s.mailer.Send(user.Email, "Your aro account will be deleted", body); err != nil {
+		log.Printf("couldn't send deletion notice: %v", err)
+	}
+
+	c.JSON(StatusOK, gin.H{"deletion": request, "receipt": receipt})
+}
+
+func (s *Server) CancelDeletion(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	sql := `
+		update DeletionRequests set Status = 'cancelled', LastModified = $1
+		where UserID = $2 and Status = 'pending';`
+	tag, err := s.db.Exec(s.ctx, sql, time.Now(), user.ID)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't cancel deletion"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(StatusBadRequest, gin.H{"error": "No deletion scheduled"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
+
+func (s *Server) GetPendingDeletion(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	pending, err := getPendingDeletion(s, user.ID)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't query database"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"deletion": pending})
+}
+
+// check on a deletion with its receipt, which still works after the account is gone
+func (s *Server) GetDeletionStatus(c *gin.Context) {
+	receipt, exists := c.GetQuery("receipt")
+	if !exists {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	sql := `
+		select Status, RequestedAt, PurgeAfter, CompletedAt from DeletionRequests
+		where Receipt = $1;`
+	var r DeletionRequest
+	err := s.db.QueryRow(s.ctx, sql, hashToken(receipt)).Scan(
+		&r.Status, &r.RequestedAt, &r.PurgeAfter, &r.CompletedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(StatusBadRequest, gin.H{"error": "Unknown receipt"})
+		return
+	} else if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't query database"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"deletion": r})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	verifyEmailPurpose   = "verify-email"
+	resetPasswordPurpose = "reset-password"
+
+	verifyEmailLifetime   = 48 * time.Hour
+	resetPasswordLifetime = time.Hour
+)
+
+var errInvalidEmailToken = errors.New("invalid or expired token")
+
+// only accept bare addresses like "me@example.com"
+func validEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
+}
+
+// create a single use token, replacing any unused ones
+// with the same purpose the user already has
+func createEmailToken(s *Server, userID uint, purpose string, lifetime time.Duration) (string, error) {
+	token, hash, err := createRandomToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(s.ctx)
+
+	sql := `
+		update EmailTokens set Used = true, LastModified = $1
+		where UserID = $2 and Purpose = $3 and Used = false;`
+	if _, err := tx.Exec(s.ctx, sql, time.Now(), userID, purpose); err != nil {
+		return "", err
+	}
+
+	sql = `
+		insert into EmailTokens
+		(LastModified, Used, UserID, Purpose, Token, ExpiresAt)
+		values ($1, $2, $3, $4, $5, $6);`
+	now := time.Now()
+	if _, err := tx.Exec(s.ctx, sql, now, false, userID, purpose,
+		hash, now.Add(lifetime)); err != nil {
+		return "", err
+	}
+
+	return token, tx.Commit(s.ctx)
+}
+
+// mark the token as used and return the user it was issued to
+func consumeEmailToken(s *Server, token string, purpose string) (uint, error) {
+	sql := `
+		update EmailTokens set Used = true, LastModified = $1
+		where Token = $2 and Purpose = $3 and Used = false and ExpiresAt > $1
+		returning UserID;`
+	var userID uint
+	err := s.db.QueryRow(s.ctx, sql, time.Now(), hashToken(token), purpose).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, errInvalidEmailToken
+	}
+	return userID, err
+}
+
+func tokenLink(s *Server, path string, token string) string {
+	if s.config.AppURL == "" {
+		return token
+	}
+	return fmt.Sprintf("%s/%s?token=%s",
+		strings.TrimSuffix(s.config.AppURL, "/"), path, url.QueryEscape(token))
+}
+
+func sendVerificationEmail(s *Server, user *User) error {
+	token, err := createEmailToken(s, user.ID, verifyEmailPurpose, verifyEmailLifetime)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf(
+		"Welcome to aro!\n\nConfirm your email address using this link:\n%s\n\n"+
+			"It expires in %d hours.\n", tokenLink(s, "verify-email", token),
+		int(verifyEmailLifetime.Hours()))
+	return s.mailer.Send(user.Email, "Verify your email", body)
+}
+
+func sendPasswordResetEmail(s *Server, user *User) error {
+	token, err := createEmailToken(s, user.ID, resetPasswordPurpose, resetPasswordLifetime)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf(
+		"Someone asked to reset the password for your aro account.\n\n"+
+			"Reset it using this link:\n%s\n\nIt expires in %d minutes. "+
+			"If this wasn't you, you can ignore this email.\n",
+		tokenLink(s, "reset-password", token), int(resetPasswordLifetime.Minutes()))
+	return s.mailer.Send(user.Email, "Reset your password", body)
+}
+
+// api endpoints
+type TokenRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password,omitempty"`
+}
+
+func (s *Server) SendVerificationEmail(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+	if user.EmailVerified {
+		c.JSON(StatusBadRequest, gin.H{"error": "Email already verified"})
+		return
+	}
+
+	if err := sendVerificationEmail(s, user); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't send email"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
+
+func (s *Server) VerifyEmail(c *gin.Context) {
+	var req TokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, err := consumeEmailToken(s, req.Token, verifyEmailPurpose)
+	if errors.Is(err, errInvalidEmailToken) {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	} else if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't verify email"})
+		return
+	}
+
+	sql := "update Users set EmailVerified = true, LastModified = $1 where ID = $2;"
+	if _, err := s.db.Exec(s.ctx, sql, time.Now(), userID); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't verify email"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
+
+// always respond the same way, so this can't be used to find out who has an account
+func (s *Server) ForgotPassword(c *gin.Context) {
+	var req AuthRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := getUser(s, "Email", req.Email)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Coudln't query database"})
+		return
+	}
+
+	if user != nil {
+		if err := sendPasswordResetEmail(s, user); err != nil {
+			log.Printf("couldn't send password reset email: %v", err)
+		}
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
+
+func (s *Server) ResetPassword(c *gin.Context) {
+	var req TokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Password == "" {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	userID, err := consumeEmailToken(s, req.Token, resetPasswordPurpose)
+	if errors.Is(err, errInvalidEmailToken) {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	} else if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't reset password"})
+		return
+	}
+
+	password, err := hashPassword(req.Password, s.config.Argon2)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Error hashing password"})
+		return
+	}
+
+	// the reset link was sent to the inbox, so it also proves the email is theirs
+	sql := `
+		update Users set Password = $1, EmailVerified = true, LastModified = $2
+		where ID = $3;`
+	if _, err := s.db.Exec(s.ctx, sql, password, time.Now(), userID); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't reset password"})
+		return
+	}
+
+	// log out everywhere in case the old password was compromised
+	if err := revokeSessions(s, userID, 0); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't end sessions"})
+		return
+	}
+	if err := revokeAPITokens(s, userID); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't revoke tokens"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -13,17 +18,28 @@ type Food struct {
 	Name             string    `json:"name"`
 	ServingSizes     []float64 `json:"servingSizes"`
 	ServingSizeUnits []string  `json:"servingUnits"`
+	Barcode          string    `json:"barcode,omitempty"` // as a GTIN-14
 
-	// per 1 g, TODO: include more macro/micro nutrients
-	Calories      float64 `json:"calories"`
-	Protein       float64 `json:"protein"`
-	Carbohydrates float64 `json:"carbohydrates"`
-	Fat           float64 `json:"fat"`
-	Cholesterol   float64 `json:"cholesterol"`
-	Calcium       float64 `json:"calcium"`
-	Sodium        float64 `json:"sodium"`
-	Magnesium     float64 `json:"magnesium"`
-	Potassium     float64 `json:"potassium"`
+	// where the food was cached from, like "openfoodfacts", and its id there.
+	// empty for foods created by users
+	Source   string `json:"source,omitempty"`
+	SourceID string `json:"sourceID,omitempty"`
+
+	// nutrient code -> amount per 1 g of food, in the unit from the catalog
+	Nutrients map[string]float64 `json:"nutrients"`
+
+	// for measuring the food in volumes (g per ml) and units
+	// like "slice" (unit -> grams), see FoodUnits
+	Density  float64            `json:"density,omitempty"`
+	Portions map[string]float64 `json:"portions,omitempty"`
+
+	// foods created by users are private unless shared. editing a food
+	// creates a new version, so meals logged against the old one don't change
+	UserID   uint `json:"-"` // 0 for foods from a provider
+	Shared   bool `json:"shared"`
+	Version  int  `json:"version,omitempty"`
+	Outdated bool `json:"outdated,omitempty"` // a newer version exists
+	Deleted  bool `json:"deleted,omitempty"`
 }
 
 type Meal struct {
@@ -32,18 +48,26 @@ type Meal struct {
 	FoodID   uint   `json:"foodID"`
 	Children []Meal `json:"children"`
 
-	Name        string `json:"name"`
-	Servings    int    `json:"servings,omitempty"`
-	ServingSize int    `json:"servingSize,omitempty"`
-	ServingUnit string `json:"servingUnit,omitempty"`
+	Name        string  `json:"name"`
+	Servings    float64 `json:"servings,omitempty"`
+	ServingSize float64 `json:"servingSize,omitempty"`
+	ServingUnit string  `json:"servingUnit,omitempty"`
+
+	Food *Food `json:"food,omitempty"` // filled in when reading meals back
 }
 
 type DailyFoodLog struct {
+	Deleted bool   `json:"deleted,omitempty"`
 	Date    string `json:"date"`
 	MealIDs []uint `json:"meals"`
+	Meals   []Meal `json:"mealTrees"` // the meals of MealIDs, with everything below them
+
+	// the day's nutrition, like GetNutrition reports it
+	Totals NutritionTotals `json:"totals,omitempty"`
+	Goals  []GoalProgress  `json:"goals,omitempty"`
 }
 
-func createMeal(s *Server, meal Meal, userID, parentID uint) (Meal, error) {
+func createMeal(s *Server, tx pgx.Tx, meal Meal, userID, parentID uint) (Meal, error) {
 	sql := `
 		insert into Meals
 		(LastModified, Deleted, UserID, ParentID, FoodID,
@@ -52,14 +76,14 @@ func createMeal(s *Server, meal Meal, userID, parentID uint) (Meal, error) {
 		returning ID;`
 
 	temp := meal
-	err := s.db.QueryRow(s.ctx, sql, time.Now(), false, userID, meal.ParentID,
+	err := tx.QueryRow(s.ctx, sql, time.Now(), false, userID, parentID,
 		meal.FoodID, meal.Name, meal.Servings, meal.ServingSize, meal.ServingUnit).Scan(&temp.ID)
 	if err != nil {
 		return Meal{}, err
 	}
 
 	for i, child := range meal.Children {
-		tempChild, err := createMeal(s, child, userID, temp.ID)
+		tempChild, err := createMeal(s, tx, child, userID, temp.ID)
 		if err != nil {
 			return Meal{}, err
 		}
@@ -69,40 +93,408 @@ func createMeal(s *Server, meal Meal, userID, parentID uint) (Meal, error) {
 	return temp, nil
 }
 
-// NOTE: Users will not be allowed to delete scheduled
-// meals or the meals that make up the daily food logs
-func deleteMeal(s *Server, meal Meal, userID uint) error {
-	sql := `update Meals set Deleted = true, LastModified = $1 where UserID = $2 and ID = $3;`
-	if _, err := s.db.Exec(s.ctx, sql, time.Now(), userID, meal.ID); err != nil {
-		return err
+// insert the day's log along with its meals
+func createLogMeals(s *Server, tx pgx.Tx, userID uint, meals []Meal) ([]Meal, []uint, error) {
+	ids := []uint{}
+	for i, meal := range meals {
+		meal, err := createMeal(s, tx, meal, userID, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		meals[i] = meal
+		ids = append(ids, meal.ID)
 	}
+	return meals, ids, nil
+}
 
-	for _, child := range meal.Children {
-		if err := deleteMeal(s, child, userID); err != nil {
-			return err
+func createFoodLog(s *Server, tx pgx.Tx, userID uint, date string, meals []Meal) ([]Meal, error) {
+	meals, ids, err := createLogMeals(s, tx, userID, meals)
+	if err != nil {
+		return nil, err
+	}
+
+	sql := `
+		insert into DailyFoodLogs
+		(LastModified, Deleted, UserID, Date, MealIDs)
+		values ($1, $2, $3, $4, $5);`
+	_, err = tx.Exec(s.ctx, sql, time.Now(), false, userID, date, ids)
+	return meals, err
+}
+
+// a deleted log keeps its row, since the date is unique, so it's
+// brought back with the meals instead of inserting another one
+func restoreFoodLog(s *Server, tx pgx.Tx, userID uint, date string, meals []Meal) ([]Meal, error) {
+	meals, ids, err := createLogMeals(s, tx, userID, meals)
+	if err != nil {
+		return nil, err
+	}
+
+	sql := `
+		update DailyFoodLogs set Deleted = false, MealIDs = $1, LastModified = $2
+		where UserID = $3 and Date = $4;`
+	_, err = tx.Exec(s.ctx, sql, ids, time.Now(), userID, date)
+	return meals, err
+}
+
+// load the meal trees below the roots, in the order of rootIDs
+func getMealTrees(s *Server, userID uint, rootIDs []uint) ([]Meal, error) {
+	scanMeal := func(rows pgx.Rows) (Meal, error) {
+		var m Meal
+		err := rows.Scan(&m.ID, &m.ParentID, &m.FoodID, &m.Name,
+			&m.Servings, &m.ServingSize, &m.ServingUnit)
+		m.Children = []Meal{}
+		return m, err
+	}
+
+	sql := `
+		with recursive tree as (
+			select ID, ParentID, FoodID, Name, Servings, ServingSize, ServingUnit
+			from Meals where ID = any($2) and UserID = $1 and Deleted = false
+			union all
+			select Meals.ID, Meals.ParentID, Meals.FoodID, Meals.Name,
+			       Meals.Servings, Meals.ServingSize, Meals.ServingUnit
+			from Meals join tree on Meals.ParentID = tree.ID
+			where Meals.UserID = $1 and Meals.Deleted = false
+		)
+		select ID, ParentID, FoodID, Name, Servings, ServingSize, ServingUnit
+		from tree order by ID;`
+	meals, err := fetchRows(s, sql, scanMeal, userID, rootIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := map[uint]Meal{}
+	children := map[uint][]uint{}
+	for _, m := range meals {
+		byID[m.ID] = m
+		children[m.ParentID] = append(children[m.ParentID], m.ID)
+	}
+
+	var build func(id uint) Meal
+	build = func(id uint) Meal {
+		m := byID[id]
+		for _, child := range children[id] {
+			m.Children = append(m.Children, build(child))
 		}
+		return m
 	}
-	return nil
+
+	trees := []Meal{}
+	for _, id := range rootIDs {
+		if _, exists := byID[id]; exists {
+			trees = append(trees, build(id))
+		}
+	}
+	return trees, nil
 }
 
-func getFoodLogs(s *Server, options FetchOptions) ([]DailyFoodLog, error) {
-	scanLog := func(rows pgx.Rows) (DailyFoodLog, error) {
-		var l DailyFoodLog
-		err := rows.Scan(&l.Date, &l.MealIDs)
-		return l, err
+// a copy of the meal tree that createMeal will insert as new meals
+func copyMeal(meal Meal) Meal {
+	meal.ID = 0
+	children := []Meal{}
+	for _, child := range meal.Children {
+		children = append(children, copyMeal(child))
 	}
+	meal.Children = children
+	return meal
+}
 
+// make sure every food in the meal tree is one the user can see, measured
+// in a unit that can be converted to grams, so that it can be totalled
+func validateMealUnits(s *Server, meal *Meal, userID uint) error {
+	foodIDs := []uint{}
+	var collect func(m *Meal)
+	collect = func(m *Meal) {
+		if m.FoodID != 0 {
+			foodIDs = append(foodIDs, m.FoodID)
+		}
+		for i := range m.Children {
+			collect(&m.Children[i])
+		}
+	}
+	collect(meal)
+
+	units, err := getVisibleFoodUnits(s, foodIDs, userID)
+	if err != nil {
+		return err
+	}
+
+	// a meal is either a food or a group of other meals, never both
+	var validate func(m *Meal) error
+	validate = func(m *Meal) error {
+		if m.FoodID != 0 && len(m.Children) > 0 {
+			return fmt.Errorf("%s is a food, so it can't have meals in it", m.Name)
+		}
+		if m.Servings < 0 {
+			return fmt.Errorf("Invalid servings for %s", m.Name)
+		}
+		if m.FoodID != 0 {
+			food, exists := units[m.FoodID]
+			if !exists {
+				return fmt.Errorf("Unknown food %d", m.FoodID)
+			}
+			if m.ServingSize <= 0 {
+				return fmt.Errorf("Invalid serving size for %s", m.Name)
+			}
+			if _, err := food.servingGrams(m.Servings, m.ServingSize, m.ServingUnit); err != nil {
+				return fmt.Errorf("Can't measure %s in %s", m.Name, m.ServingUnit)
+			}
+			m.ServingUnit = normalizeUnit(m.ServingUnit)
+		}
+		for i := range m.Children {
+			if err := validate(&m.Children[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return validate(meal)
+}
+
+// NOTE: Users will not be allowed to delete scheduled
+// meals or the meals that make up the daily food logs
+func deleteMeal(s *Server, tx pgx.Tx, userID, mealID uint) (bool, error) {
+	return deleteMealTree(s, tx, userID, mealID, "ID")
+}
+
+// soft delete everything below the meal, but not the meal itself
+func deleteMealChildren(s *Server, tx pgx.Tx, userID, mealID uint) error {
+	_, err := deleteMealTree(s, tx, userID, mealID, "ParentID")
+	return err
+}
+
+// what's below the meal is read from the database, rather than trusting
+// the client's copy of the tree. root is the column that matches mealID
+func deleteMealTree(s *Server, tx pgx.Tx, userID, mealID uint, root string) (bool, error) {
+	sql := fmt.Sprintf(`
+		with recursive tree as (
+			select ID from Meals where %s = $3 and UserID = $2 and Deleted = false
+			union all
+			select Meals.ID from Meals join tree on Meals.ParentID = tree.ID
+			where Meals.UserID = $2 and Meals.Deleted = false
+		)
+		update Meals set Deleted = true, LastModified = $1
+		where ID in (select ID from tree);`, root)
+	tag, err := tx.Exec(s.ctx, sql, time.Now(), userID, mealID)
+	return tag.RowsAffected() > 0, err
+}
+
+// the parent has to be one of the user's meals rather than a food, and
+// can't be the meal itself or anything below it. mealID is 0 for new meals
+func validParent(s *Server, tx pgx.Tx, userID, mealID, parentID uint) (bool, error) {
+	var valid bool
+	sql := `
+		with recursive tree as (
+			select ID from Meals where ID = $1
+			union all
+			select Meals.ID from Meals join tree on Meals.ParentID = tree.ID
+		)
+		select exists (
+			select 1 from Meals
+			where ID = $2 and UserID = $3 and Deleted = false and FoodID = 0
+			and ID not in (select ID from tree)
+		);`
+	err := tx.QueryRow(s.ctx, sql, mealID, parentID, userID).Scan(&valid)
+	return valid, err
+}
+
+func getFoodLogs(s *Server, options FetchOptions) ([]DailyFoodLog, error) {
 	sql := `select Deleted, Date, MealIDs from DailyFoodLogs
 			where UserID = $1  and LastModified >= $2
 			order by DailyFoodLogs.Date desc
 			limit $3 offset $4;`
-	logs, err := fetchRows(s, sql, scanLog, options.userID,
+	logs, err := fetchRows(s, sql, scanFoodLog, options.userID,
 		options.timestamp, options.limit, options.page)
 	if err != nil {
 		return nil, err
 	}
 
-	return logs, nil
+	if err := addLogMeals(s, options.userID, logs); err != nil {
+		return nil, err
+	}
+	return logs, addLogNutrition(s, options.userID, logs)
+}
+
+func scanFoodLog(rows pgx.Rows) (DailyFoodLog, error) {
+	var l DailyFoodLog
+	err := rows.Scan(&l.Deleted, &l.Date, &l.MealIDs)
+	l.Meals = []Meal{}
+	return l, err
+}
+
+// the logs of the dates, in the same order, skipping days that haven't been logged
+func getFoodLogsOn(s *Server, userID uint, dates []string) ([]DailyFoodLog, error) {
+	sql := `select Deleted, Date, MealIDs from DailyFoodLogs
+			where UserID = $1 and Date = any($2) and Deleted = false
+			order by array_position($2, Date);`
+	logs, err := fetchRows(s, sql, scanFoodLog, userID, dates)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := addLogMeals(s, userID, logs); err != nil {
+		return nil, err
+	}
+	return logs, addLogNutrition(s, userID, logs)
+}
+
+// fill in the meal trees of the logs, along with the foods in them.
+// every tree is read with one recursive query rather than a query per meal
+func addLogMeals(s *Server, userID uint, logs []DailyFoodLog) error {
+	rootIDs := []uint{}
+	for _, l := range logs {
+		if !l.Deleted {
+			rootIDs = append(rootIDs, l.MealIDs...)
+		}
+	}
+	if len(rootIDs) == 0 {
+		return nil
+	}
+
+	trees, err := getMealTrees(s, userID, rootIDs)
+	if err != nil {
+		return err
+	}
+
+	foodIDs := []uint{}
+	var collect func(m Meal)
+	collect = func(m Meal) {
+		if m.FoodID != 0 {
+			foodIDs = append(foodIDs, m.FoodID)
+		}
+		for _, child := range m.Children {
+			collect(child)
+		}
+	}
+	for _, tree := range trees {
+		collect(tree)
+	}
+
+	// old versions and deleted foods are still what the meals were logged with
+	sql := fmt.Sprintf("select %s from Foods where Foods.ID = any($1) and %s;",
+		foodColumns, visibleFoods(2))
+	foods, err := fetchRows(s, sql, scanFood, foodIDs, userID)
+	if err != nil {
+		return err
+	}
+	byID := map[string]*Food{}
+	for i := range foods {
+		byID[foods[i].ID] = &foods[i]
+	}
+
+	var attach func(m *Meal)
+	attach = func(m *Meal) {
+		if m.FoodID != 0 {
+			m.Food = byID[fmt.Sprint(m.FoodID)]
+		}
+		for i := range m.Children {
+			attach(&m.Children[i])
+		}
+	}
+	roots := map[uint]Meal{}
+	for _, tree := range trees {
+		attach(&tree)
+		roots[tree.ID] = tree
+	}
+
+	for i := range logs {
+		if logs[i].Deleted {
+			continue
+		}
+		for _, id := range logs[i].MealIDs {
+			if meal, exists := roots[id]; exists {
+				logs[i].Meals = append(logs[i].Meals, meal)
+			}
+		}
+	}
+	return nil
+}
+
+// check the parts of a food users can set themselves
+func validateFood(s *Server, food *Food) error {
+	if strings.TrimSpace(food.Name) == "" ||
+		len(food.ServingSizes) != len(food.ServingSizeUnits) {
+		return errors.New("Invalid food")
+	}
+
+	if food.Barcode != "" {
+		barcode, valid := normalizeBarcode(food.Barcode)
+		if !valid {
+			return errors.New("Invalid barcode")
+		}
+		food.Barcode = barcode
+	}
+
+	if food.Density < 0 {
+		return errors.New("Invalid density")
+	}
+	portions := map[string]float64{}
+	for unit, grams := range food.Portions {
+		if unit = normalizeUnit(unit); unit == "" || grams <= 0 {
+			return errors.New("Invalid portion")
+		}
+		portions[unit] = grams
+	}
+	food.Portions = portions
+
+	// every serving size has to be measurable in grams
+	units := FoodUnits{Density: food.Density, Portions: food.Portions}
+	for i, size := range food.ServingSizes {
+		if _, err := units.toGrams(size, food.ServingSizeUnits[i]); err != nil || size <= 0 {
+			return errors.New("Invalid serving size")
+		}
+		food.ServingSizeUnits[i] = normalizeUnit(food.ServingSizeUnits[i])
+	}
+
+	return validateNutrients(s, food.Nutrients)
+}
+
+// insert a version of a user's food along with its nutrients
+func insertUserFood(s *Server, tx pgx.Tx, food Food, previousID *uint) (uint, error) {
+	codes, amounts := nutrientArrays(food.Nutrients)
+	portions, grams := nutrientArrays(food.Portions)
+	sql := `
+		with food as (
+			insert into Foods
+			(LastModified, Name, ServingSizes, ServingSizeUnits, Barcode, Density,
+			 UserID, Shared, Version, PreviousID, Latest, Deleted)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, true, false)
+			returning ID
+		), nutrients as (
+			insert into FoodNutrients (FoodID, Code, Amount)
+			select food.ID, n.Code, n.Amount
+			from food, unnest($11::text[], $12::float[]) n(Code, Amount)
+		), portions as (
+			insert into FoodPortions (FoodID, Unit, Grams)
+			select food.ID, p.Unit, p.Grams
+			from food, unnest($13::text[], $14::float[]) p(Unit, Grams)
+		)
+		select ID from food;`
+
+	var foodID uint
+	err := tx.QueryRow(s.ctx, sql, time.Now(), food.Name, food.ServingSizes,
+		food.ServingSizeUnits, food.Barcode, food.Density, food.UserID, food.Shared,
+		food.Version, previousID, codes, amounts, portions, grams).Scan(&foodID)
+	return foodID, err
+}
+
+// the latest version of a food the user owns, locked until the transaction ends
+func getOwnedFood(s *Server, tx pgx.Tx, foodID, userID uint) (*Food, error) {
+	sql := fmt.Sprintf(`
+		select %s from Foods
+		where ID = $1 and UserID = $2 and Latest = true and Deleted = false
+		for update;`, foodColumns)
+	rows, err := tx.Query(s.ctx, sql, foodID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	food, err := scanFood(rows)
+	return &food, err
 }
 
 func (s *Server) CreateFood(c *gin.Context) {
@@ -111,18 +503,26 @@ func (s *Server) CreateFood(c *gin.Context) {
 		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	user := c.MustGet("user").(*User)
+
+	if err := validateFood(s, &req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.UserID = user.ID
+	req.Version = 1
 
-	sql := `
-		insert into Foods
-		(LastModified, Name, ServingSizes, ServingSizeUnits, Calories,
-		 Protein, Carbohydrates, Fat, Cholesterol, Calcium, Sodium, Magnesium, Potassium)
-		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
-		returning ID;`
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Coudln't create food"})
+		return
+	}
+	defer tx.Rollback(s.ctx)
 
-	var foodID uint
-	err := s.db.QueryRow(s.ctx, sql, time.Now(), req.Name, req.ServingSizes,
-		req.ServingSizeUnits, req.Calories, req.Protein, req.Carbohydrates, req.Fat,
-		req.Cholesterol, req.Calcium, req.Sodium, req.Magnesium, req.Potassium)
+	foodID, err := insertUserFood(s, tx, req, nil)
+	if err == nil {
+		err = tx.Commit(s.ctx)
+	}
 	if err != nil {
 		c.JSON(StatusInternalServerError, gin.H{"error": "Coudln't create food"})
 		return
@@ -131,15 +531,269 @@ func (s *Server) CreateFood(c *gin.Context) {
 	c.JSON(StatusOK, gin.H{"foodID": foodID})
 }
 
-// TODO!
+// replaces the food with a new version. the new version gets its own id,
+// which is sent back
+func (s *Server) UpdateFood(c *gin.Context) {
+	var req Food
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := c.MustGet("user").(*User)
+
+	id, err := strconv.ParseUint(req.ID, 10, 64)
+	if err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if err := validateFood(s, &req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't update food"})
+		return
+	}
+	defer tx.Rollback(s.ctx)
+
+	previous, err := getOwnedFood(s, tx, uint(id), user.ID)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't update food"})
+		return
+	}
+	if previous == nil {
+		c.JSON(StatusBadRequest, gin.H{"error": "Food not found"})
+		return
+	}
+
+	sql := `update Foods set Latest = false, LastModified = $1 where ID = $2;`
+	if _, err := tx.Exec(s.ctx, sql, time.Now(), id); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't update food"})
+		return
+	}
+
+	req.UserID = user.ID
+	req.Version = previous.Version + 1
+	previousID := uint(id)
+	foodID, err := insertUserFood(s, tx, req, &previousID)
+	if err == nil {
+		err = tx.Commit(s.ctx)
+	}
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't update food"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"foodID": foodID})
+}
+
+// foods are only hidden from searches, meals using them still work
+func (s *Server) DeleteFood(c *gin.Context) {
+	idStr, exists := c.GetQuery("id")
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if !exists || err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	user := c.MustGet("user").(*User)
+
+	sql := `
+		update Foods set Deleted = true, LastModified = $1
+		where ID = $2 and UserID = $3 and Latest = true and Deleted = false;`
+	tag, err := s.db.Exec(s.ctx, sql, time.Now(), id, user.ID)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't delete food"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(StatusBadRequest, gin.H{"error": "Food not found"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
+
+// the columns scanFood expects, in order
+const foodColumns = `
+	Foods.ID::text, Foods.Name, Foods.ServingSizes, Foods.ServingSizeUnits,
+	Foods.Source, Foods.SourceID, Foods.Barcode,
+	coalesce((select jsonb_object_agg(Code, Amount) from FoodNutrients
+	          where FoodID = Foods.ID), '{}'),
+	coalesce(Foods.UserID, 0), Foods.Shared, Foods.Version,
+	not Foods.Latest, Foods.Deleted, Foods.Density,
+	coalesce((select jsonb_object_agg(Unit, Grams) from FoodPortions
+	          where FoodID = Foods.ID), '{}')`
+
+func scanFood(rows pgx.Rows) (Food, error) {
+	var f Food
+	err := rows.Scan(&f.ID, &f.Name, &f.ServingSizes, &f.ServingSizeUnits,
+		&f.Source, &f.SourceID, &f.Barcode, &f.Nutrients,
+		&f.UserID, &f.Shared, &f.Version, &f.Outdated, &f.Deleted,
+		&f.Density, &f.Portions)
+	return f, err
+}
+
+// foods from providers and shared foods are visible to everyone,
+// other foods only to the user who created them
+func visibleFoods(userParam int) string {
+	return fmt.Sprintf(
+		"(Foods.UserID is null or Foods.Shared = true or Foods.UserID = $%d)", userParam)
+}
+
+type FoodSearch struct {
+	UserID uint
+	Query  string
+	Page   int
+	Limit  int
+
+	// nutrient -> bound, per 1 g like the Food struct
+	Min map[string]float64
+	Max map[string]float64
+
+	// the user's usual foods, best first, which rank above other matches
+	Usual []uint
+}
+
+// the sql limit and offset of a page. one extra result is fetched
+// to know if there's another page, without moving the offset
+func pageWindow(page, limit int) (int, int) {
+	return limit + 1, page * limit
+}
+
+// drop the extra result pageWindow asked for, if it came back
+func trimPage[T any](results []T, limit int) ([]T, bool) {
+	if len(results) > limit {
+		return results[:limit], true
+	}
+	return results, false
+}
+
+// rank foods by how well the full text search matches, plus how similar
+// the name is, so that typos and partial words still find something.
+// also returns whether there's another page
+func searchFoods(s *Server, search FoodSearch) ([]Food, bool, error) {
+	args := []any{search.Query, search.UserID}
+	conditions := []string{visibleFoods(2)}
+
+	// foods without the nutrient have none of it
+	addBounds := func(bounds map[string]float64, operator string) {
+		for nutrient, bound := range bounds {
+			args = append(args, nutrient, bound)
+			conditions = append(conditions, fmt.Sprintf(`
+				coalesce((select Amount from FoodNutrients
+				          where FoodID = Foods.ID and Code = $%d), 0) %s $%d`,
+				len(args)-1, operator, len(args)))
+		}
+	}
+	addBounds(search.Min, ">=")
+	addBounds(search.Max, "<=")
+
+	filters := strings.Join(conditions, " and ")
+
+	limit, offset := pageWindow(search.Page, search.Limit)
+	args = append(args, search.Usual, limit, offset)
+	sql := fmt.Sprintf(`
+		select %s from Foods, websearch_to_tsquery('english', $1) query
+		where (to_tsvector('english', Foods.Name) @@ query or Foods.Name %% $1)
+		and Foods.Latest = true and Foods.Deleted = false and %s
+		order by array_position($%d::int[], Foods.ID) nulls last,
+			ts_rank(to_tsvector('english', Foods.Name), query)
+			+ similarity(Foods.Name, $1) desc, Foods.ID
+		limit $%d offset $%d;`, foodColumns, filters, len(args)-2, len(args)-1, len(args))
+
+	foods, err := fetchRows(s, sql, scanFood, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	foods, more := trimPage(foods, search.Limit)
+	return foods, more, nil
+}
+
 func (s *Server) FindFood(c *gin.Context) {
-	_, exists := c.GetQuery("query")
-	if !exists {
+	query, exists := c.GetQuery("query")
+	query = strings.TrimSpace(query)
+	if !exists || query == "" {
 		c.JSON(StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
 
-	c.JSON(StatusOK, gin.H{"results": []Food{}})
+	user := c.MustGet("user").(*User)
+
+	search := FoodSearch{
+		UserID: user.ID, Query: query, Limit: 20,
+		Min: map[string]float64{}, Max: map[string]float64{},
+	}
+
+	var err error
+	if page, exists := c.GetQuery("page"); exists {
+		search.Page, err = strconv.Atoi(page)
+		if err != nil || search.Page < 0 {
+			c.JSON(StatusBadRequest, gin.H{"error": "Invalid page"})
+			return
+		}
+	}
+	if limit, exists := c.GetQuery("limit"); exists {
+		search.Limit, err = strconv.Atoi(limit)
+		if err != nil || search.Limit < 1 || search.Limit > 100 {
+			c.JSON(StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+	}
+
+	nutrients, err := getNutrients(s)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't search foods"})
+		return
+	}
+
+	// filters look like ?minProtein=0.2&maxSaturatedFat=0.05
+	for _, nutrient := range nutrients {
+		name := strings.ToUpper(nutrient.Code[:1]) + nutrient.Code[1:]
+		for prefix, bounds := range map[string]map[string]float64{
+			"min": search.Min, "max": search.Max} {
+			value, exists := c.GetQuery(prefix + name)
+			if !exists {
+				continue
+			}
+			bound, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				c.JSON(StatusBadRequest, gin.H{"error": "Invalid " + prefix + name})
+				return
+			}
+			bounds[nutrient.Code] = bound
+		}
+	}
+
+	search.Usual, err = usualFoods(s, user.ID)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't search foods"})
+		return
+	}
+
+	foods, more, err := searchFoods(s, search)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't search foods"})
+		return
+	}
+
+	// not much cached yet, ask the provider. the foods it finds are cached,
+	// so later pages and searches pick them up locally
+	if s.foods != nil && !more && search.Page == 0 && len(search.Min)+len(search.Max) == 0 {
+		found, err := searchProvider(s, query, 0)
+		if err != nil {
+			log.Printf("couldn't search food provider: %v", err)
+		}
+		for _, food := range found {
+			cached := slices.ContainsFunc(foods, func(f Food) bool { return f.ID == food.ID })
+			if !cached && len(foods) < search.Limit {
+				foods = append(foods, food)
+			}
+		}
+	}
+
+	c.JSON(StatusOK, gin.H{"results": foods, "more": more})
 }
 
 func (s *Server) GetFoodByID(c *gin.Context) {
@@ -150,23 +804,20 @@ func (s *Server) GetFoodByID(c *gin.Context) {
 		return
 	}
 
-	scanFood := func(rows pgx.Rows) (Food, error) {
-		var f Food
-		err := rows.Scan(&f.Name, &f.ServingSizes, &f.ServingSizeUnits, &f.Calories,
-			&f.Protein, &f.Carbohydrates, &f.Fat, &f.Cholesterol, &f.Calcium,
-			&f.Sodium, &f.Magnesium, &f.Potassium)
-		return f, err
-	}
+	user := c.MustGet("user").(*User)
 
-	sql := `
-		select Name, ServingSizes, ServingSizeUnits, Calories,
-		 Protein, Carbohydrates, Fat, Cholesterol, Calcium, Sodium, Magnesium, Potassium
-		from Foods where ID = $1;`
-	foods, err := fetchRows(s, sql, scanFood, id)
+	// old versions and deleted foods are still around for the meals using them
+	sql := fmt.Sprintf("select %s from Foods where ID = $1 and %s;",
+		foodColumns, visibleFoods(2))
+	foods, err := fetchRows(s, sql, scanFood, id, user.ID)
 	if err != nil {
 		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't find food"})
 		return
 	}
+	if len(foods) == 0 {
+		c.JSON(StatusBadRequest, gin.H{"error": "Food not found"})
+		return
+	}
 
 	c.JSON(StatusOK, gin.H{"food": foods[0]})
 }
@@ -179,7 +830,34 @@ func (s *Server) CreateMeal(c *gin.Context) {
 	}
 	user := c.MustGet("user").(*User)
 
-	meal, err := createMeal(s, req, user.ID, req.ParentID)
+	if err := validateMealUnits(s, &req, user.ID); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't create meal"})
+		return
+	}
+	defer tx.Rollback(s.ctx)
+
+	if req.ParentID != 0 {
+		valid, err := validParent(s, tx, user.ID, 0, req.ParentID)
+		if err != nil {
+			c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't create meal"})
+			return
+		}
+		if !valid {
+			c.JSON(StatusBadRequest, gin.H{"error": "Invalid parent meal"})
+			return
+		}
+	}
+
+	meal, err := createMeal(s, tx, req, user.ID, req.ParentID)
+	if err == nil {
+		err = tx.Commit(s.ctx)
+	}
 	if err != nil {
 		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't create meal"})
 		return
@@ -188,6 +866,94 @@ func (s *Server) CreateMeal(c *gin.Context) {
 	c.JSON(StatusOK, gin.H{"updatedMeal": meal})
 }
 
+// replaces the meal and everything below it with the request's tree,
+// all or nothing, and responds with the tree as it's been stored
+func (s *Server) UpdateMeal(c *gin.Context) {
+	var req Meal
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := c.MustGet("user").(*User)
+
+	if err := validateMealUnits(s, &req, user.ID); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't update meal"})
+		return
+	}
+	defer tx.Rollback(s.ctx)
+
+	var parentID uint
+	sql := "select ParentID from Meals where ID = $1 and UserID = $2 and Deleted = false for update;"
+	err = tx.QueryRow(s.ctx, sql, req.ID, user.ID).Scan(&parentID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(StatusBadRequest, gin.H{"error": "Meal not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't update meal"})
+		return
+	}
+	if parentID == 0 && req.FoodID != 0 {
+		c.JSON(StatusBadRequest, gin.H{"error": "Meal slots can't be foods"})
+		return
+	}
+
+	// the meal stays where it is unless it's given another parent
+	if req.ParentID != 0 && req.ParentID != parentID {
+		if parentID == 0 {
+			c.JSON(StatusBadRequest, gin.H{"error": "Meal slots can't be moved"})
+			return
+		}
+		valid, err := validParent(s, tx, user.ID, req.ID, req.ParentID)
+		if err != nil {
+			c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't update meal"})
+			return
+		}
+		if !valid {
+			c.JSON(StatusBadRequest, gin.H{"error": "Invalid parent meal"})
+			return
+		}
+		parentID = req.ParentID
+	}
+
+	sql = `
+		update Meals set LastModified = $1, ParentID = $2, FoodID = $3,
+		Name = $4, Servings = $5, ServingSize = $6, ServingUnit = $7
+		where ID = $8;`
+	_, err = tx.Exec(s.ctx, sql, time.Now(), parentID, req.FoodID,
+		req.Name, req.Servings, req.ServingSize, req.ServingUnit, req.ID)
+	if err == nil {
+		err = deleteMealChildren(s, tx, user.ID, req.ID)
+	}
+	for _, child := range req.Children {
+		if err != nil {
+			break
+		}
+		_, err = createMeal(s, tx, child, user.ID, req.ID)
+	}
+	if err == nil {
+		err = tx.Commit(s.ctx)
+	}
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't update meal"})
+		return
+	}
+
+	trees, err := getMealTrees(s, user.ID, []uint{req.ID})
+	if err != nil || len(trees) == 0 {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't get meal"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"updatedMeal": trees[0]})
+}
+
 func (s *Server) DeleteMeal(c *gin.Context) {
 	var req Meal
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -196,14 +962,31 @@ func (s *Server) DeleteMeal(c *gin.Context) {
 	}
 	user := c.MustGet("user").(*User)
 
-	if err := deleteMeal(s, req, user.ID); err != nil {
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't delete meal"})
+		return
+	}
+	defer tx.Rollback(s.ctx)
+
+	found, err := deleteMeal(s, tx, user.ID, req.ID)
+	if err == nil {
+		err = tx.Commit(s.ctx)
+	}
+	if err != nil {
 		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't delete meal"})
 		return
 	}
+	if !found {
+		c.JSON(StatusBadRequest, gin.H{"error": "Meal not found"})
+		return
+	}
 
 	c.JSON(StatusOK, gin.H{})
 }
 
+// creates the ?date= log with the meals from the user's schedule,
+// or with copies of the meals logged on ?copyFrom=
 func (s *Server) CreateFoodLog(c *gin.Context) {
 	date, exists := c.GetQuery("date")
 	if !exists {
@@ -212,25 +995,72 @@ func (s *Server) CreateFoodLog(c *gin.Context) {
 	}
 	user := c.MustGet("user").(*User)
 
-	ids := []uint{}
-	for _, name := range user.ScheuledMeals {
-		meal, err := createMeal(s, Meal{Name: name, Children: []Meal{}}, user.ID, 0)
-		if err != nil {
-			c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't create meal"})
+	var meals []Meal
+	var err error
+	if from, copying := c.GetQuery("copyFrom"); copying {
+		meals, err = copiedMeals(s, user.ID, from)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(StatusBadRequest, gin.H{"error": "Food log not found"})
 			return
 		}
+	} else {
+		meals, err = scheduledMeals(s, user)
+	}
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't create meal"})
+		return
+	}
+
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't create food log"})
+		return
+	}
+	defer tx.Rollback(s.ctx)
+
+	meals, err = createFoodLog(s, tx, user.ID, date, meals)
+	if err == nil {
+		err = tx.Commit(s.ctx)
+	}
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't create food log"})
+		return
+	}
+
+	ids := []uint{}
+	for _, meal := range meals {
 		ids = append(ids, meal.ID)
 	}
 
-	sql := `
-		insert into DailyFoodLogs
-		(LastModified, Deleted, UserID, Date, MealIDs)
-		values ($1, $2, $3, $4, $5) returning ID;`
-	_, err := s.db.Exec(s.ctx, sql, time.Now(), false, user.ID, date, ids)
+	c.JSON(StatusOK, gin.H{"mealIDs": ids, "meals": meals})
+}
+
+// the logs of a single ?date= or every day from ?from= to ?to=,
+// with their meal trees and the foods in them
+func (s *Server) GetFoodLogs(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	from, to := c.Query("from"), c.Query("to")
+	if date, exists := c.GetQuery("date"); exists {
+		from, to = date, date
+	}
+
+	dates, err := logDateRange(from, to)
+	if err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	formatted := []string{}
+	for _, date := range dates {
+		formatted = append(formatted, date.Format(logDateLayout))
+	}
+
+	logs, err := getFoodLogsOn(s, user.ID, formatted)
 	if err != nil {
-		c.JSON(StatusInternalServerError, gin.H{"error": "Coudln't create food log"})
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't get daily food logs"})
 		return
 	}
 
-	c.JSON(StatusOK, gin.H{"mealIDs": ids})
+	c.JSON(StatusOK, gin.H{"dailyFoodLogs": logs})
 }
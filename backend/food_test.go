@@ -0,0 +1,40 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// page through a known result set the way searchFoods does, with a
+// fake query standing in for the database's limit and offset
+func TestSearchPaging(t *testing.T) {
+	results := []int{}
+	for i := range 45 {
+		results = append(results, i)
+	}
+	query := func(limit, offset int) []int {
+		end := min(offset+limit, len(results))
+		if offset >= end {
+			return []int{}
+		}
+		return results[offset:end]
+	}
+
+	for _, limit := range []int{1, 7, 20, 45, 100} {
+		seen := []int{}
+		for page := 0; ; page++ {
+			sqlLimit, offset := pageWindow(page, limit)
+			found, more := trimPage(query(sqlLimit, offset), limit)
+			if len(found) > limit {
+				t.Fatalf("limit %d page %d: got %d results", limit, page, len(found))
+			}
+			seen = append(seen, found...)
+			if !more {
+				break
+			}
+		}
+		if !slices.Equal(seen, results) {
+			t.Errorf("limit %d: paged through %v, want %v", limit, seen, results)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// an external database of foods, whose results get cached into Foods
+type FoodProvider interface {
+	Search(query string, page int) ([]Food, error)
+	// returns nil when the provider doesn't know the barcode
+	Barcode(code string) (*Food, error)
+}
+
+func newFoodProvider(config Config) FoodProvider {
+	switch config.FoodProvider {
+	case "openfoodfacts":
+		return &OpenFoodFactsProvider{
+			BaseURL:   strings.TrimSuffix(config.OpenFoodFactsURL, "/"),
+			UserAgent: config.OpenFoodFactsUserAgent,
+			client:    &http.Client{Timeout: 10 * time.Second},
+		}
+	case "fixtures":
+		return &FixtureProvider{Dir: config.FoodFixturesDir}
+	}
+	return nil
+}
+
+// insert a food from a provider or a dump along with its nutrients and
+// portions, or refresh the copy we already have. condition can skip the insert
+func upsertFoodSQL(condition string) string {
+	return fmt.Sprintf(`
+		with food as (
+			insert into Foods
+			(LastModified, Name, ServingSizes, ServingSizeUnits,
+			 Source, SourceID, Barcode, Density)
+			select $1, $2, $3, $4, $5, $6, $7, $8 %s
+			on conflict (Source, SourceID) where Source != '' do update set
+			LastModified = excluded.LastModified, Name = excluded.Name,
+			ServingSizes = excluded.ServingSizes,
+			ServingSizeUnits = excluded.ServingSizeUnits,
+			Barcode = excluded.Barcode, Density = excluded.Density
+			returning ID
+		), removed as (
+			delete from FoodNutrients
+			where FoodID in (select ID from food) and Code != all($9::text[])
+		), nutrients as (
+			insert into FoodNutrients (FoodID, Code, Amount)
+			select food.ID, n.Code, n.Amount
+			from food, unnest($9::text[], $10::float[]) n(Code, Amount)
+			on conflict (FoodID, Code) do update set Amount = excluded.Amount
+		), removedPortions as (
+			delete from FoodPortions
+			where FoodID in (select ID from food) and Unit != all($11::text[])
+		), portions as (
+			insert into FoodPortions (FoodID, Unit, Grams)
+			select food.ID, p.Unit, p.Grams
+			from food, unnest($11::text[], $12::float[]) p(Unit, Grams)
+			on conflict (FoodID, Unit) do update set Grams = excluded.Grams
+		)
+		select ID::text from food;`, condition)
+}
+
+func upsertFoodArgs(food Food) []any {
+	codes, amounts := nutrientArrays(food.Nutrients)
+	portions, grams := nutrientArrays(food.Portions)
+	return []any{time.Now(), food.Name, food.ServingSizes, food.ServingSizeUnits,
+		food.Source, food.SourceID, food.Barcode, food.Density,
+		codes, amounts, portions, grams}
+}
+
+// store the provider's food in Foods and fill in its id
+func cacheFood(s *Server, food *Food) error {
+	sql := upsertFoodSQL("")
+	return s.db.QueryRow(s.ctx, sql, upsertFoodArgs(*food)...).Scan(&food.ID)
+}
+
+// search the provider and cache what it found
+func searchProvider(s *Server, query string, page int) ([]Food, error) {
+	foods, err := s.foods.Search(query, page)
+	if err != nil {
+		return nil, err
+	}
+	for i := range foods {
+		if err := cacheFood(s, &foods[i]); err != nil {
+			return nil, err
+		}
+	}
+	return foods, nil
+}
+
+// a product in the openfoodfacts api responses
+type offProduct struct {
+	Code                string         `json:"code"`
+	ProductName         string         `json:"product_name"`
+	ServingQuantity     offNumber      `json:"serving_quantity"`
+	ServingQuantityUnit string         `json:"serving_quantity_unit"`
+	Nutriments          map[string]any `json:"nutriments"`
+}
+
+type offProductResponse struct {
+	Status  int        `json:"status"`
+	Product offProduct `json:"product"`
+}
+
+type offSearchResponse struct {
+	Products []offProduct `json:"products"`
+}
+
+// openfoodfacts sends numbers as strings every now and then
+type offNumber float64
+
+func (n *offNumber) UnmarshalJSON(data []byte) error {
+	value, ok := parseOFFNumber(json.RawMessage(data))
+	if ok {
+		*n = offNumber(value)
+	}
+	return nil
+}
+
+func parseOFFNumber(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	case json.RawMessage:
+		var decoded any
+		if err := json.Unmarshal(v, &decoded); err != nil {
+			return 0, false
+		}
+		return parseOFFNumber(decoded)
+	}
+	return 0, false
+}
+
+// openfoodfacts nutriment -> nutrient code and how many of the
+// nutrient's unit there are in a gram, since openfoodfacts uses grams
+var offNutrients = map[string]struct {
+	Code  string
+	Scale float64
+}{
+	"proteins":            {"protein", 1},
+	"carbohydrates":       {"carbohydrates", 1},
+	"fat":                 {"fat", 1},
+	"saturated-fat":       {"saturatedFat", 1},
+	"trans-fat":           {"transFat", 1},
+	"monounsaturated-fat": {"monounsaturatedFat", 1},
+	"polyunsaturated-fat": {"polyunsaturatedFat", 1},
+	"cholesterol":         {"cholesterol", 1e3},
+	"fiber":               {"fiber", 1},
+	"sugars":              {"sugars", 1},
+	"added-sugars":        {"addedSugars", 1},
+	"sodium":              {"sodium", 1e3},
+	"potassium":           {"potassium", 1e3},
+	"calcium":             {"calcium", 1e3},
+	"magnesium":           {"magnesium", 1e3},
+	"iron":                {"iron", 1e3},
+	"zinc":                {"zinc", 1e3},
+	"phosphorus":          {"phosphorus", 1e3},
+	"caffeine":            {"caffeine", 1e3},
+	"vitamin-a":           {"vitaminA", 1e6},
+	"vitamin-c":           {"vitaminC", 1e3},
+	"vitamin-d":           {"vitaminD", 1e6},
+	"vitamin-e":           {"vitaminE", 1e3},
+	"vitamin-k":           {"vitaminK", 1e6},
+	"vitamin-b1":          {"thiamin", 1e3},
+	"vitamin-b2":          {"riboflavin", 1e3},
+	"vitamin-pp":          {"niacin", 1e3},
+	"vitamin-b6":          {"vitaminB6", 1e3},
+	"vitamin-b9":          {"folate", 1e6},
+	"vitamin-b12":         {"vitaminB12", 1e6},
+}
+
+// openfoodfacts gives nutrients per 100 g
+func (p offProduct) toFood() (Food, bool) {
+	calories, hasCalories := parseOFFNumber(p.Nutriments["energy-kcal_100g"])
+	if !hasCalories {
+		kilojoules, hasKilojoules := parseOFFNumber(p.Nutriments["energy_100g"])
+		if !hasKilojoules {
+			return Food{}, false
+		}
+		calories = kilojoules / 4.184
+	}
+
+	name := strings.TrimSpace(p.ProductName)
+	if name == "" || p.Code == "" {
+		return Food{}, false
+	}
+
+	// openfoodfacts also has products without a real barcode
+	barcode, _ := normalizeBarcode(p.Code)
+
+	food := Food{
+		Name:     name,
+		Source:   "openfoodfacts",
+		SourceID: p.Code,
+		Barcode:  barcode,
+
+		ServingSizes:     []float64{100},
+		ServingSizeUnits: []string{"g"},
+
+		Nutrients: map[string]float64{"calories": calories / 100},
+	}
+	for name, nutrient := range offNutrients {
+		if value, exists := parseOFFNumber(p.Nutriments[name+"_100g"]); exists {
+			food.Nutrients[nutrient.Code] = value * nutrient.Scale / 100
+		}
+	}
+
+	if p.ServingQuantity > 0 {
+		unit := p.ServingQuantityUnit
+		if unit == "" {
+			unit = "g"
+		}
+		food.ServingSizes = append(food.ServingSizes, float64(p.ServingQuantity))
+		food.ServingSizeUnits = append(food.ServingSizeUnits, unit)
+	}
+
+	return food, true
+}
+
+func decodeOFFProduct(body io.Reader) (*Food, error) {
+	var response offProductResponse
+	if err := json.NewDecoder(body).Decode(&response); err != nil {
+		return nil, err
+	}
+	if response.Status != 1 {
+		return nil, nil
+	}
+
+	food, ok := response.Product.toFood()
+	if !ok {
+		return nil, nil
+	}
+	return &food, nil
+}
+
+func decodeOFFSearch(body io.Reader) ([]Food, error) {
+	var response offSearchResponse
+	if err := json.NewDecoder(body).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	foods := []Food{}
+	for _, product := range response.Products {
+		if food, ok := product.toFood(); ok {
+			foods = append(foods, food)
+		}
+	}
+	return foods, nil
+}
+
+const offFields = "code,product_name,nutriments,serving_quantity,serving_quantity_unit"
+
+type OpenFoodFactsProvider struct {
+	BaseURL   string
+	UserAgent string // openfoodfacts asks apps to identify themselves
+	client    *http.Client
+}
+
+func (p *OpenFoodFactsProvider) get(path string, params url.Values) (io.ReadCloser, error) {
+	request, err := http.NewRequest("GET", p.BaseURL+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", p.UserAgent)
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNotFound {
+		response.Body.Close()
+		return nil, fmt.Errorf("openfoodfacts returned %s", response.Status)
+	}
+	return response.Body, nil
+}
+
+func (p *OpenFoodFactsProvider) Search(query string, page int) ([]Food, error) {
+	params := url.Values{}
+	params.Set("search_terms", query)
+	params.Set("search_simple", "1")
+	params.Set("action", "process")
+	params.Set("json", "1")
+	params.Set("page", strconv.Itoa(page+1))
+	params.Set("page_size", "20")
+	params.Set("fields", offFields)
+
+	body, err := p.get("/cgi/search.pl", params)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return decodeOFFSearch(body)
+}
+
+func (p *OpenFoodFactsProvider) Barcode(code string) (*Food, error) {
+	params := url.Values{}
+	params.Set("fields", offFields)
+
+	body, err := p.get("/api/v2/product/"+url.PathEscape(code)+".json", params)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return decodeOFFProduct(body)
+}
+
+// serves saved openfoodfacts responses instead of calling the api, for
+// development and tests. products are read from <dir>/product/<barcode>.json
+// and searches from <dir>/search/<query>.json
+type FixtureProvider struct {
+	Dir string
+}
+
+func (p *FixtureProvider) open(kind string, name string) (*os.File, error) {
+	path := filepath.Join(p.Dir, kind, filepath.Base(name)+".json")
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return file, err
+}
+
+func (p *FixtureProvider) Search(query string, page int) ([]Food, error) {
+	if page > 0 {
+		return []Food{}, nil
+	}
+	file, err := p.open("search", strings.ToLower(query))
+	if file == nil || err != nil {
+		return []Food{}, err
+	}
+	defer file.Close()
+	return decodeOFFSearch(file)
+}
+
+func (p *FixtureProvider) Barcode(code string) (*Food, error) {
+	file, err := p.open("product", code)
+	if file == nil || err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return decodeOFFProduct(file)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestOFFProductToFood(t *testing.T) {
+	tests := []struct {
+		name     string
+		product  offProduct
+		ok       bool
+		barcode  string
+		calories float64 // per gram
+		sizes    []float64
+		units    []string
+	}{
+		{
+			name: "calories and serving",
+			product: offProduct{
+				Code: "3017620422003", ProductName: " Nutella ",
+				ServingQuantity: 15, ServingQuantityUnit: "g",
+				Nutriments: map[string]any{"energy-kcal_100g": 539.0},
+			},
+			ok: true, barcode: "03017620422003", calories: 5.39,
+			sizes: []float64{100, 15}, units: []string{"g", "g"},
+		},
+		{
+			name: "kilojoules only",
+			product: offProduct{
+				Code: "3017620422003", ProductName: "Nutella",
+				Nutriments: map[string]any{"energy_100g": 418.4},
+			},
+			ok: true, barcode: "03017620422003", calories: 1,
+			sizes: []float64{100}, units: []string{"g"},
+		},
+		{
+			name: "numbers as strings and no serving unit",
+			product: offProduct{
+				Code: "3017620422003", ProductName: "Nutella", ServingQuantity: 30,
+				Nutriments: map[string]any{"energy-kcal_100g": "250"},
+			},
+			ok: true, barcode: "03017620422003", calories: 2.5,
+			sizes: []float64{100, 30}, units: []string{"g", "g"},
+		},
+		{
+			name: "not a real barcode",
+			product: offProduct{
+				Code: "12345", ProductName: "Homemade",
+				Nutriments: map[string]any{"energy-kcal_100g": 100.0},
+			},
+			ok: true, barcode: "", calories: 1,
+			sizes: []float64{100}, units: []string{"g"},
+		},
+		{
+			name: "no energy",
+			product: offProduct{
+				Code: "3017620422003", ProductName: "Nutella",
+				Nutriments: map[string]any{"proteins_100g": 6.3},
+			},
+		},
+		{
+			name: "no name",
+			product: offProduct{
+				Code: "3017620422003", ProductName: "  ",
+				Nutriments: map[string]any{"energy-kcal_100g": 539.0},
+			},
+		},
+		{
+			name: "no code",
+			product: offProduct{
+				ProductName: "Nutella",
+				Nutriments:  map[string]any{"energy-kcal_100g": 539.0},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		food, ok := test.product.toFood()
+		if ok != test.ok {
+			t.Errorf("%s: got ok %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if food.Name != strings.TrimSpace(test.product.ProductName) {
+			t.Errorf("%s: got name %q", test.name, food.Name)
+		}
+		if food.Source != "openfoodfacts" || food.SourceID != test.product.Code {
+			t.Errorf("%s: got source %q %q", test.name, food.Source, food.SourceID)
+		}
+		if food.Barcode != test.barcode {
+			t.Errorf("%s: got barcode %q, want %q", test.name, food.Barcode, test.barcode)
+		}
+		if !closeTo(food.Nutrients["calories"], test.calories) {
+			t.Errorf("%s: got %v calories, want %v",
+				test.name, food.Nutrients["calories"], test.calories)
+		}
+		if !slices.Equal(food.ServingSizes, test.sizes) ||
+			!slices.Equal(food.ServingSizeUnits, test.units) {
+			t.Errorf("%s: got servings %v %v, want %v %v", test.name,
+				food.ServingSizes, food.ServingSizeUnits, test.sizes, test.units)
+		}
+	}
+}
+
+// nutrients are stored per gram, in the nutrient's own unit
+func TestOFFNutrientScale(t *testing.T) {
+	product := offProduct{
+		Code: "3017620422003", ProductName: "Nutella",
+		Nutriments: map[string]any{
+			"energy-kcal_100g": 539.0,
+			"proteins_100g":    6.3,
+			"sodium_100g":      0.0428,
+			"vitamin-d_100g":   0.000005,
+		},
+	}
+	food, ok := product.toFood()
+	if !ok {
+		t.Fatal("product wasn't converted")
+	}
+
+	expected := map[string]float64{
+		"protein": 0.063, "sodium": 0.428, "vitaminD": 0.05,
+	}
+	for code, value := range expected {
+		if !closeTo(food.Nutrients[code], value) {
+			t.Errorf("%s: got %v, want %v", code, food.Nutrients[code], value)
+		}
+	}
+	if _, exists := food.Nutrients["fat"]; exists {
+		t.Error("got fat, which the product doesn't list")
+	}
+}
+
+func TestFixtureSearch(t *testing.T) {
+	provider := &FixtureProvider{Dir: "fixtures/openfoodfacts"}
+	tests := []struct {
+		query string
+		page  int
+		names []string
+	}{
+		{"nutella", 0, []string{"Nutella"}},
+		{"NUTELLA", 0, []string{"Nutella"}},
+		{"nutella", 1, []string{}},
+		{"not cached", 0, []string{}},
+		{"../product/3017620422003", 0, []string{}},
+	}
+
+	for _, test := range tests {
+		foods, err := provider.Search(test.query, test.page)
+		if err != nil {
+			t.Errorf("%q page %d: %v", test.query, test.page, err)
+			continue
+		}
+		names := []string{}
+		for _, food := range foods {
+			names = append(names, food.Name)
+		}
+		if !slices.Equal(names, test.names) {
+			t.Errorf("%q page %d: got %v, want %v", test.query, test.page, names, test.names)
+		}
+	}
+}
+
+func TestFixtureBarcode(t *testing.T) {
+	provider := &FixtureProvider{Dir: "fixtures/openfoodfacts"}
+
+	food, err := provider.Barcode("3017620422003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if food == nil {
+		t.Fatal("product not found")
+	}
+	if food.Name != "Nutella" || food.Barcode != "03017620422003" {
+		t.Errorf("got %q with barcode %q", food.Name, food.Barcode)
+	}
+	if !slices.Equal(food.ServingSizes, []float64{100, 15}) {
+		t.Errorf("got serving sizes %v", food.ServingSizes)
+	}
+
+	food, err = provider.Barcode("0000000000000")
+	if err != nil || food != nil {
+		t.Errorf("unknown barcode: got %v, %v", food, err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// a daily goal for a nutrient, from EffectiveFrom until a newer goal for the
+// same nutrient replaces it. goals can be set for every day or for a single
+// day of the week. a goal without a min or max clears the nutrient's goal,
+// or for a single weekday, clears the override so the every day goal applies
+type Goal struct {
+	Nutrient      string   `json:"nutrient"`
+	Weekday       *int     `json:"weekday,omitempty"` // 0 is sunday, every day when left out
+	Min           *float64 `json:"min,omitempty"`
+	Max           *float64 `json:"max,omitempty"`
+	EffectiveFrom string   `json:"effectiveFrom"`
+
+	effectiveFrom time.Time
+}
+
+type GoalProgress struct {
+	Nutrient string   `json:"nutrient"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	Amount   float64  `json:"amount"`
+	Status   string   `json:"status"` // under, met or over
+}
+
+// every day is stored as -1, since the weekday is part of the unique key
+const everyDay = -1
+
+func getGoalHistory(s *Server, userID uint, until time.Time) ([]Goal, error) {
+	scanGoal := func(rows pgx.Rows) (Goal, error) {
+		var g Goal
+		var weekday int
+		err := rows.Scan(&g.Nutrient, &weekday, &g.Min, &g.Max, &g.effectiveFrom)
+		if weekday != everyDay {
+			g.Weekday = &weekday
+		}
+		g.EffectiveFrom = g.effectiveFrom.Format(logDateLayout)
+		return g, err
+	}
+
+	sql := `
+		select Code, Weekday, Min, Max, EffectiveFrom from NutritionGoals
+		where UserID = $1 and EffectiveFrom <= $2
+		order by EffectiveFrom desc, Weekday desc;`
+	return fetchRows(s, sql, scanGoal, userID, until)
+}
+
+// the goals in effect on the date, from the history sorted newest first.
+// a newer goal for every day replaces older goals for single weekdays, and
+// a cleared weekday goal falls back to the every day goal, however old
+func goalsOn(history []Goal, date time.Time) []Goal {
+	goals := []Goal{}
+	seen := map[string]bool{}
+	overrideCleared := map[string]bool{}
+	for _, goal := range history {
+		applies := goal.Weekday == nil || *goal.Weekday == int(date.Weekday())
+		if seen[goal.Nutrient] || !applies || goal.effectiveFrom.After(date) {
+			continue
+		}
+		empty := goal.Min == nil && goal.Max == nil
+		if goal.Weekday != nil {
+			if overrideCleared[goal.Nutrient] {
+				continue
+			}
+			if empty {
+				overrideCleared[goal.Nutrient] = true
+				continue
+			}
+		}
+		seen[goal.Nutrient] = true
+		if !empty {
+			goals = append(goals, goal)
+		}
+	}
+	return goals
+}
+
+func goalProgress(goals []Goal, totals NutritionTotals) []GoalProgress {
+	progress := []GoalProgress{}
+	for _, goal := range goals {
+		p := GoalProgress{
+			Nutrient: goal.Nutrient, Min: goal.Min, Max: goal.Max,
+			Amount: totals[goal.Nutrient], Status: "met",
+		}
+		if goal.Min != nil && p.Amount < *goal.Min {
+			p.Status = "under"
+		} else if goal.Max != nil && p.Amount > *goal.Max {
+			p.Status = "over"
+		}
+		progress = append(progress, p)
+	}
+	return progress
+}
+
+// api endpoints
+type GoalsRequest struct {
+	Goals         []Goal `json:"goals"`
+	EffectiveFrom string `json:"effectiveFrom,omitempty"` // today when left out
+}
+
+func (s *Server) SetGoals(c *gin.Context) {
+	var req GoalsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := c.MustGet("user").(*User)
+
+	effectiveFrom := time.Now()
+	if req.EffectiveFrom != "" {
+		date, err := parseLogDate(req.EffectiveFrom)
+		if err != nil {
+			c.JSON(StatusBadRequest, gin.H{"error": "Invalid date"})
+			return
+		}
+		effectiveFrom = date
+	}
+	effectiveFrom = time.Date(effectiveFrom.Year(), effectiveFrom.Month(),
+		effectiveFrom.Day(), 0, 0, 0, 0, time.UTC)
+
+	nutrients, err := getNutrients(s)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't set goals"})
+		return
+	}
+	for _, goal := range req.Goals {
+		known := slices.ContainsFunc(nutrients, func(n Nutrient) bool {
+			return n.Code == goal.Nutrient
+		})
+		validWeekday := goal.Weekday == nil || (*goal.Weekday >= 0 && *goal.Weekday <= 6)
+		validRange := goal.Min == nil || goal.Max == nil || *goal.Min <= *goal.Max
+		nonNegative := (goal.Min == nil || *goal.Min >= 0) && (goal.Max == nil || *goal.Max >= 0)
+		if !known || !validWeekday || !validRange || !nonNegative {
+			c.JSON(StatusBadRequest, gin.H{"error": "Invalid goal for " + goal.Nutrient})
+			return
+		}
+	}
+
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't set goals"})
+		return
+	}
+	defer tx.Rollback(s.ctx)
+
+	sql := `
+		insert into NutritionGoals
+		(LastModified, UserID, Code, Weekday, Min, Max, EffectiveFrom)
+		values ($1, $2, $3, $4, $5, $6, $7)
+		on conflict (UserID, Code, Weekday, EffectiveFrom) do update set
+		LastModified = excluded.LastModified, Min = excluded.Min, Max = excluded.Max;`
+	for _, goal := range req.Goals {
+		weekday := everyDay
+		if goal.Weekday != nil {
+			weekday = *goal.Weekday
+		}
+		_, err := tx.Exec(s.ctx, sql, time.Now(), user.ID, goal.Nutrient,
+			weekday, goal.Min, goal.Max, effectiveFrom)
+		if err != nil {
+			c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't set goals"})
+			return
+		}
+	}
+
+	if err := tx.Commit(s.ctx); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't set goals"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
+
+// the goals in effect on ?date= (today by default), along with their history
+func (s *Server) GetGoals(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	date := time.Now()
+	if value, exists := c.GetQuery("date"); exists {
+		parsed, err := parseLogDate(value)
+		if err != nil {
+			c.JSON(StatusBadRequest, gin.H{"error": "Invalid date"})
+			return
+		}
+		date = parsed
+	}
+
+	// including goals that only start in the future
+	history, err := getGoalHistory(s, user.ID, time.Now().AddDate(100, 0, 0))
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't get goals"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"goals": goalsOn(history, date), "history": history})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestGoalsOn(t *testing.T) {
+	date := func(day int) time.Time { return time.Date(2025, 3, day, 0, 0, 0, 0, time.UTC) }
+	bound := func(v float64) *float64 { return &v }
+	monday := int(time.Monday)
+	goal := func(weekday *int, max *float64, from time.Time) Goal {
+		return Goal{Nutrient: "calories", Weekday: weekday, Max: max, effectiveFrom: from}
+	}
+
+	// march 3, 2025 is a monday
+	tests := []struct {
+		name    string
+		history []Goal // newest first
+		date    time.Time
+		max     []float64
+	}{
+		{
+			name:    "every day",
+			history: []Goal{goal(nil, bound(2000), date(1))},
+			date:    date(3), max: []float64{2000},
+		},
+		{
+			name:    "not yet in effect",
+			history: []Goal{goal(nil, bound(2000), date(5))},
+			date:    date(3), max: []float64{},
+		},
+		{
+			name: "weekday override",
+			history: []Goal{
+				goal(&monday, bound(2500), date(2)), goal(nil, bound(2000), date(1)),
+			},
+			date: date(3), max: []float64{2500},
+		},
+		{
+			name: "override on another day",
+			history: []Goal{
+				goal(&monday, bound(2500), date(2)), goal(nil, bound(2000), date(1)),
+			},
+			date: date(4), max: []float64{2000},
+		},
+		{
+			name: "newer every day goal replaces the override",
+			history: []Goal{
+				goal(nil, bound(1800), date(2)), goal(&monday, bound(2500), date(1)),
+			},
+			date: date(3), max: []float64{1800},
+		},
+		{
+			name: "cleared override falls back to every day",
+			history: []Goal{
+				goal(&monday, nil, date(2)), goal(&monday, bound(2500), date(1)),
+				goal(nil, bound(2000), date(1)),
+			},
+			date: date(3), max: []float64{2000},
+		},
+		{
+			name: "cleared every day goal",
+			history: []Goal{
+				goal(nil, nil, date(2)), goal(nil, bound(2000), date(1)),
+			},
+			date: date(3), max: []float64{},
+		},
+	}
+
+	for _, test := range tests {
+		max := []float64{}
+		for _, g := range goalsOn(test.history, test.date) {
+			max = append(max, *g.Max)
+		}
+		if !slices.Equal(max, test.max) {
+			t.Errorf("%s: got %v, want %v", test.name, max, test.max)
+		}
+	}
+}
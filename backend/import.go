@@ -0,0 +1,483 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// usage: aro import-foods -format fdc|fdc-csv|off -file <path>
+//
+// fdc is one of the FoodData Central json releases, fdc-csv the folder of an
+// unzipped csv release and off the openfoodfacts jsonl dump (gzipped or not).
+// progress is saved after every batch, so running the same command again
+// picks up where an interrupted import stopped
+func runImportFoods(s *Server, args []string) error {
+	flags := flag.NewFlagSet("import-foods", flag.ExitOnError)
+	format := flags.String("format", "", "fdc, fdc-csv or off")
+	file := flags.String("file", "", "the dump to import")
+	restart := flags.Bool("restart", false, "ignore the progress of earlier runs")
+	flags.Parse(args)
+
+	importFile := map[string]func(string, *FoodImporter) error{
+		"fdc": importFDCJSON, "fdc-csv": importFDCCSV, "off": importOFFDump,
+	}[*format]
+	if importFile == nil || *file == "" {
+		flags.Usage()
+		return errors.New("missing format or file")
+	}
+
+	importer, err := newFoodImporter(s, *format, *file, *restart)
+	if err != nil {
+		return err
+	}
+	if importer.completed {
+		log.Printf("%s was already imported, use -restart to import it again", *file)
+		return nil
+	}
+	if importer.skip > 0 {
+		log.Printf("resuming after %d records", importer.skip)
+	}
+
+	if err := importFile(*file, importer); err != nil {
+		return err
+	}
+	return importer.finish()
+}
+
+const importBatchSize = 1000
+
+// writes foods in batches, keeping track of how many records of the dump
+// have been handled so that an interrupted import can be resumed
+type FoodImporter struct {
+	s         *Server
+	format    string
+	file      string
+	completed bool
+
+	skip     int // records handled by earlier runs
+	records  int
+	imported int
+	batch    []Food
+}
+
+func newFoodImporter(s *Server, format, file string, restart bool) (*FoodImporter, error) {
+	importer := &FoodImporter{s: s, format: format, file: filepath.Base(file)}
+	if restart {
+		return importer, nil
+	}
+
+	sql := `select Imported, Completed from FoodImports where Format = $1 and File = $2;`
+	err := s.db.QueryRow(s.ctx, sql, format, importer.file).Scan(
+		&importer.skip, &importer.completed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return importer, nil
+	}
+	return importer, err
+}
+
+// called for every record in the dump, valid or not, so that
+// the record count lines up when resuming
+func (i *FoodImporter) add(food Food, valid bool) error {
+	i.records++
+	if i.records <= i.skip {
+		return nil
+	}
+
+	if valid {
+		i.batch = append(i.batch, food)
+	}
+	if i.records%importBatchSize == 0 {
+		return i.flush(false)
+	}
+	return nil
+}
+
+// foods already in the database from the same source are updated. foods
+// with a barcode another source already has are skipped as duplicates
+func (i *FoodImporter) flush(completed bool) error {
+	tx, err := i.s.db.Begin(i.s.ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(i.s.ctx)
+
+	sql := upsertFoodSQL(`
+		where $7 = '' or not exists (
+			select 1 from Foods where Barcode = $7 and Source != $5)`)
+
+	batch := &pgx.Batch{}
+	now := time.Now()
+	for _, food := range i.batch {
+		batch.Queue(sql, upsertFoodArgs(food)...)
+	}
+	batch.Queue(`
+		insert into FoodImports (LastModified, Format, File, Imported, Completed)
+		values ($1, $2, $3, $4, $5)
+		on conflict (Format, File) do update set LastModified = excluded.LastModified,
+		Imported = excluded.Imported, Completed = excluded.Completed;`,
+		now, i.format, i.file, i.records, completed)
+
+	if err := tx.SendBatch(i.s.ctx, batch).Close(); err != nil {
+		return err
+	}
+	if err := tx.Commit(i.s.ctx); err != nil {
+		return err
+	}
+
+	i.imported += len(i.batch)
+	i.batch = i.batch[:0]
+	log.Printf("handled %d records, imported %d foods", i.records, i.imported)
+	return nil
+}
+
+func (i *FoodImporter) finish() error {
+	return i.flush(true)
+}
+
+func openDump(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil || !strings.HasSuffix(path, ".gz") {
+		return file, err
+	}
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, file}, nil
+}
+
+// every line of the openfoodfacts dump is a product, like the api returns
+func importOFFDump(path string, importer *FoodImporter) error {
+	file, err := openDump(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		var product offProduct
+		err := decoder.Decode(&product)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("record %d: %w", importer.records+1, err)
+		}
+
+		food, valid := product.toFood()
+		if err := importer.add(food, valid); err != nil {
+			return err
+		}
+	}
+}
+
+// FoodData Central nutrient numbers. amounts are per 100 g,
+// in the same units as the nutrient catalog
+const (
+	fdcEnergy        = "208" // kcal
+	fdcEnergyKJ      = "268"
+	fdcEnergyAtwater = "957" // foundation foods only have these
+)
+
+var fdcNutrients = map[string]string{
+	"203": "protein",
+	"205": "carbohydrates",
+	"204": "fat",
+	"606": "saturatedFat",
+	"605": "transFat",
+	"645": "monounsaturatedFat",
+	"646": "polyunsaturatedFat",
+	"601": "cholesterol",
+	"291": "fiber",
+	"269": "sugars",
+	"539": "addedSugars",
+	"221": "alcohol",
+	"262": "caffeine",
+	"307": "sodium",
+	"306": "potassium",
+	"301": "calcium",
+	"304": "magnesium",
+	"303": "iron",
+	"309": "zinc",
+	"305": "phosphorus",
+	"320": "vitaminA",
+	"401": "vitaminC",
+	"328": "vitaminD",
+	"323": "vitaminE",
+	"430": "vitaminK",
+	"404": "thiamin",
+	"405": "riboflavin",
+	"406": "niacin",
+	"415": "vitaminB6",
+	"417": "folate",
+	"418": "vitaminB12",
+}
+
+// the csv releases refer to nutrients by id instead of number
+var fdcNutrientIDs = map[string]string{
+	"1008": fdcEnergy, "1062": fdcEnergyKJ, "2047": fdcEnergyAtwater,
+	"1003": "203", "1005": "205", "1004": "204", "1258": "606", "1257": "605",
+	"1292": "645", "1293": "646", "1253": "601", "1079": "291", "2000": "269",
+	"1235": "539", "1018": "221", "1057": "262", "1093": "307", "1092": "306",
+	"1087": "301", "1090": "304", "1089": "303", "1095": "309", "1091": "305",
+	"1106": "320", "1162": "401", "1114": "328", "1109": "323", "1185": "430",
+	"1165": "404", "1166": "405", "1167": "406", "1175": "415", "1177": "417",
+	"1178": "418",
+}
+
+type fdcFood struct {
+	ID              string
+	Name            string
+	Nutrients       map[string]float64 // nutrient number -> amount
+	Barcode         string
+	ServingSize     float64
+	ServingSizeUnit string
+	Portions        map[string]float64 // unit -> grams
+}
+
+// portions like "1 cup, chopped" weighing 150 g. the first portion for a unit wins
+func (f *fdcFood) addPortion(unit, modifier string, amount, grams float64) {
+	if unit == "" || unit == "undetermined" {
+		unit = modifier
+	}
+	unit = normalizeUnit(unit)
+	if _, exists := f.Portions[unit]; !exists && unit != "" && amount > 0 && grams > 0 {
+		f.Portions[unit] = grams / amount
+	}
+}
+
+func (f fdcFood) toFood() (Food, bool) {
+	calories, hasCalories := f.Nutrients[fdcEnergy]
+	if !hasCalories {
+		calories, hasCalories = f.Nutrients[fdcEnergyAtwater]
+	}
+	if !hasCalories {
+		kilojoules, hasKilojoules := f.Nutrients[fdcEnergyKJ]
+		calories, hasCalories = kilojoules/4.184, hasKilojoules
+	}
+
+	name := strings.TrimSpace(f.Name)
+	if !hasCalories || name == "" || f.ID == "" {
+		return Food{}, false
+	}
+
+	barcode, _ := normalizeBarcode(f.Barcode)
+	food := Food{
+		Name:     name,
+		Source:   "usda",
+		SourceID: f.ID,
+		Barcode:  barcode,
+
+		ServingSizes:     []float64{100},
+		ServingSizeUnits: []string{"g"},
+
+		Nutrients: map[string]float64{"calories": calories / 100},
+		Portions:  f.Portions,
+	}
+	for number, amount := range f.Nutrients {
+		if code, exists := fdcNutrients[number]; exists {
+			food.Nutrients[code] = amount / 100
+		}
+	}
+
+	unit := normalizeUnit(f.ServingSizeUnit)
+	if f.ServingSize > 0 && (unit == "g" || unit == "ml") {
+		food.ServingSizes = append(food.ServingSizes, f.ServingSize)
+		food.ServingSizeUnits = append(food.ServingSizeUnits, unit)
+	}
+
+	return food, true
+}
+
+// a food in the json releases
+type fdcJSONFood struct {
+	FdcID         int    `json:"fdcId"`
+	Description   string `json:"description"`
+	FoodNutrients []struct {
+		Nutrient struct {
+			Number string `json:"number"`
+		} `json:"nutrient"`
+		Amount float64 `json:"amount"`
+	} `json:"foodNutrients"`
+	FoodPortions []struct {
+		Amount      float64 `json:"amount"`
+		GramWeight  float64 `json:"gramWeight"`
+		Modifier    string  `json:"modifier"`
+		MeasureUnit struct {
+			Name string `json:"name"`
+		} `json:"measureUnit"`
+	} `json:"foodPortions"`
+	GtinUpc         string  `json:"gtinUpc"`
+	ServingSize     float64 `json:"servingSize"`
+	ServingSizeUnit string  `json:"servingSizeUnit"`
+}
+
+// the json releases are one huge object like {"BrandedFoods": [...]},
+// so decode the foods one at a time instead of all at once
+func importFDCJSON(path string, importer *FoodImporter) error {
+	file, err := openDump(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return fmt.Errorf("couldn't find the list of foods: %w", err)
+		}
+		if token == json.Delim('[') {
+			break
+		}
+	}
+
+	for decoder.More() {
+		var f fdcJSONFood
+		if err := decoder.Decode(&f); err != nil {
+			return fmt.Errorf("record %d: %w", importer.records+1, err)
+		}
+
+		food := fdcFood{
+			ID: strconv.Itoa(f.FdcID), Name: f.Description, Barcode: f.GtinUpc,
+			Nutrients: map[string]float64{}, Portions: map[string]float64{},
+			ServingSize: f.ServingSize, ServingSizeUnit: f.ServingSizeUnit,
+		}
+		for _, n := range f.FoodNutrients {
+			food.Nutrients[n.Nutrient.Number] = n.Amount
+		}
+		for _, p := range f.FoodPortions {
+			food.addPortion(p.MeasureUnit.Name, p.Modifier, p.Amount, p.GramWeight)
+		}
+
+		converted, valid := food.toFood()
+		if err := importer.add(converted, valid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read a csv file from the release, calling fn with every row as a map
+func readFDCCSV(dir, name string, fn func(map[string]string)) error {
+	file, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	header = slices.Clone(header)
+
+	row := map[string]string{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		for i, column := range header {
+			row[column] = record[i]
+		}
+		fn(row)
+	}
+}
+
+// the csv releases split every food across several files, so they're
+// joined in memory before importing the foods in order of their id
+func importFDCCSV(dir string, importer *FoodImporter) error {
+	foods := map[string]*fdcFood{}
+	err := readFDCCSV(dir, "food.csv", func(row map[string]string) {
+		foods[row["fdc_id"]] = &fdcFood{
+			ID: row["fdc_id"], Name: row["description"],
+			Nutrients: map[string]float64{}, Portions: map[string]float64{},
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	err = readFDCCSV(dir, "food_nutrient.csv", func(row map[string]string) {
+		food, exists := foods[row["fdc_id"]]
+		number, wanted := fdcNutrientIDs[row["nutrient_id"]]
+		amount, err := strconv.ParseFloat(row["amount"], 64)
+		if exists && wanted && err == nil {
+			food.Nutrients[number] = amount
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// portions refer to the units in measure_unit.csv
+	measureUnits := map[string]string{}
+	err = readFDCCSV(dir, "measure_unit.csv", func(row map[string]string) {
+		measureUnits[row["id"]] = row["name"]
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err = readFDCCSV(dir, "food_portion.csv", func(row map[string]string) {
+		if food, exists := foods[row["fdc_id"]]; exists {
+			amount, _ := strconv.ParseFloat(row["amount"], 64)
+			grams, _ := strconv.ParseFloat(row["gram_weight"], 64)
+			food.addPortion(measureUnits[row["measure_unit_id"]], row["modifier"], amount, grams)
+		}
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// only the branded foods release has this one
+	err = readFDCCSV(dir, "branded_food.csv", func(row map[string]string) {
+		if food, exists := foods[row["fdc_id"]]; exists {
+			food.Barcode = row["gtin_upc"]
+			food.ServingSize, _ = strconv.ParseFloat(row["serving_size"], 64)
+			food.ServingSizeUnit = row["serving_size_unit"]
+		}
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	ids := []int{}
+	for id := range foods {
+		if number, err := strconv.Atoi(id); err == nil {
+			ids = append(ids, number)
+		}
+	}
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		food, valid := foods[strconv.Itoa(id)].toFood()
+		if err := importer.add(food, valid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
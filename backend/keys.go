@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// a key that can verify tokens, and sign them if we have the private half
+type SigningKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private any // nil for verification only keys
+	Public  any
+}
+
+// one key signs new tokens while the older keys keep verifying the tokens
+// they signed, so the signing key can be rotated without logging everyone out
+type KeyRing struct {
+	signing *SigningKey
+	keys    map[string]*SigningKey
+}
+
+func loadKeyRing(config Config) (*KeyRing, error) {
+	ring := &KeyRing{keys: map[string]*SigningKey{}}
+
+	if config.JWTSecret != "" {
+		ring.signing = hmacKey(config.JWTSecret)
+		ring.add(ring.signing)
+	}
+	for _, secret := range config.JWTPreviousSecrets {
+		ring.add(hmacKey(secret))
+	}
+
+	for _, path := range config.JWTVerifyKeys {
+		key, err := loadPEMKey(path)
+		if err != nil {
+			return nil, err
+		}
+		ring.add(key)
+	}
+
+	// asymmetric keys take over signing from the hmac secret
+	if config.JWTSigningKey != "" {
+		key, err := loadPEMKey(config.JWTSigningKey)
+		if err != nil {
+			return nil, err
+		}
+		if key.Private == nil {
+			return nil, fmt.Errorf("%s doesn't contain a private key", config.JWTSigningKey)
+		}
+		ring.add(key)
+		ring.signing = key
+	}
+
+	if ring.signing == nil {
+		return nil, errors.New("no jwt signing key configured")
+	}
+	return ring, nil
+}
+
+func (r *KeyRing) add(key *SigningKey) { r.keys[key.ID] = key }
+
+func (r *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(r.signing.Method, claims)
+	token.Header["kid"] = r.signing.ID
+	if r.signing.Private != nil {
+		return token.SignedString(r.signing.Private)
+	}
+	return token.SignedString(r.signing.Public)
+}
+
+func (r *KeyRing) Verify(tokenStr string) (*jwt.Token, error) {
+	return jwt.Parse(tokenStr, func(t *jwt.Token) (any, error) {
+		id, _ := t.Header["kid"].(string)
+		key, exists := r.keys[id]
+		if !exists {
+			return nil, fmt.Errorf("unknown key id: %v", t.Header["kid"])
+		}
+
+		// never let the token pick the algorithm, otherwise a public
+		// key could end up being used as an hmac secret
+		if t.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		return key.Public, nil
+	}, jwt.WithValidMethods([]string{"HS256", "RS256", "EdDSA"}))
+}
+
+// hmac secrets are shared, so the key id can't be derived from the key
+// itself like it is for public keys. use an hmac of a constant instead,
+// which doesn't reveal anything about the secret
+func hmacKey(secret string) *SigningKey {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("aro key id"))
+	id := hex.EncodeToString(mac.Sum(nil))[:16]
+	return &SigningKey{ID: id, Method: jwt.SigningMethodHS256, Public: []byte(secret)}
+}
+
+// load an Ed25519 or RSA key from a pem file. private keys can be in
+// PKCS #8 or PKCS #1 form, public keys in PKIX form
+func loadPEMKey(path string) (*SigningKey, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("%s isn't a pem file", path)
+	}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported pem block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	key := &SigningKey{}
+	switch k := parsed.(type) {
+	case ed25519.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodEdDSA, k
+	case *rsa.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodRS256, k
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T", path, parsed)
+	}
+
+	jwk, _ := publicJWK(key)
+	key.ID = jwkThumbprint(jwk)
+	return key, nil
+}
+
+// json web key representation of a public key (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+
+	Crv string `json:"crv,omitempty"` // Ed25519 and EC
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+
+	N string `json:"n,omitempty"` // RSA
+	E string `json:"e,omitempty"`
+}
+
+func publicJWK(key *SigningKey) (JWK, bool) {
+	encode := base64.RawURLEncoding.EncodeToString
+	jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+
+	switch k := key.Public.(type) {
+	case ed25519.PublicKey:
+		jwk.Kty, jwk.Crv, jwk.X = "OKP", "Ed25519", encode(k)
+	case *rsa.PublicKey:
+		jwk.Kty, jwk.N = "RSA", encode(k.N.Bytes())
+		jwk.E = encode(big.NewInt(int64(k.E)).Bytes())
+	default:
+		return JWK{}, false // hmac secrets are never published
+	}
+	return jwk, true
+}
+
+// key id derived from the key itself (RFC 7638), so every
+// replica comes up with the same id for the same key
+func jwkThumbprint(jwk JWK) string {
+	// the required members, in lexicographic order
+	var members string
+	if jwk.Kty == "OKP" {
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, jwk.Crv, jwk.Kty, jwk.X)
+	} else {
+		members = fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, jwk.E, jwk.Kty, jwk.N)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// api endpoints
+
+// publish the public keys, so other services can verify our tokens
+func (s *Server) JWKS(c *gin.Context) {
+	keys := []JWK{}
+	for _, key := range s.keys.keys {
+		if jwk, ok := publicJWK(key); ok {
+			keys = append(keys, jwk)
+		}
+	}
+
+	slices.SortFunc(keys, func(a, b JWK) int { return strings.Compare(a.Kid, b.Kid) })
+
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.JSON(StatusOK, gin.H{"keys": keys})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+func newMailer(config Config) Mailer {
+	if config.Mailer == "smtp" {
+		return &SMTPMailer{
+			Host: config.SMTPHost, Port: config.SMTPPort,
+			Username: config.SMTPUsername, Password: config.SMTPPassword,
+			From: config.MailFrom,
+		}
+	}
+	return &LogMailer{Path: config.MailLogFile, From: config.MailFrom}
+}
+
+func formatMail(from, to, subject, body string) string {
+	headers := []string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	return strings.Join(headers, "\r\n") + "\r\n\r\n" + body
+}
+
+// send mail through an smtp relay
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	// the envelope sender can't include the display name
+	from := m.From
+	if start := strings.Index(from, "<"); start != -1 {
+		from = strings.Trim(from[start:], "<>")
+	}
+
+	msg := formatMail(m.From, to, subject, body)
+	addr := net.JoinHostPort(m.Host, m.Port)
+	return smtp.SendMail(addr, auth, from, []string{to}, []byte(msg))
+}
+
+// write mail to a file (or to the log when there's no file)
+// instead of sending it, for local development and tests
+type LogMailer struct {
+	Path string
+	From string
+	mu   sync.Mutex
+}
+
+func (m *LogMailer) Send(to string, subject string, body string) error {
+	msg := formatMail(m.From, to, subject, body)
+	if m.Path == "" {
+		log.Printf("mail:\n%s\n", msg)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%s\n\n", msg)
+	return err
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"log"
+	"os"
+
 	"github.com/gin-gonic/gin"
 )
 
@@ -10,6 +13,14 @@ func main() {
 		panic(err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "import-foods" {
+		if err := runImportFoods(&server, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		server.Cleanup()
+		return
+	}
+
 	gin.SetMode(gin.DebugMode)
 	r := gin.Default()
 	r.Use(CORSMiddleware())
@@ -17,26 +28,90 @@ func main() {
 	auth := r.Group("/auth")
 	auth.Use(AuthMiddleware(&server))
 
-	r.POST("/login", server.Login)
-	r.POST("/signup", server.Signup)
+	limit := RateLimitMiddleware(server.ipLimiter)
+	r.POST("/login", limit, server.Login)
+	r.POST("/signup", limit, server.Signup)
+	r.POST("/login/totp", limit, server.LoginTOTP)
+	r.GET("/oidc", server.GetOIDCProviders)
+	r.GET("/oidc/:provider", limit, server.StartOIDC)
+	r.POST("/oidc/callback", limit, server.OIDCCallback)
+	r.POST("/token/refresh", server.RefreshToken)
+	r.GET("/.well-known/jwks.json", server.JWKS)
+	r.POST("/email/verify", server.VerifyEmail)
+	r.POST("/password/forgot", limit, server.ForgotPassword)
+	r.POST("/password/reset", limit, server.ResetPassword)
+	r.GET("/deletion", server.GetDeletionStatus)
+
+	// api tokens can't manage the account
+	account := auth.Group("", SessionOnly())
+	account.POST("/email/verify", server.SendVerificationEmail)
+	account.POST("/email", server.ChangeEmail)
+	account.POST("/password", server.ChangePassword)
+	account.POST("/totp", server.EnrollTOTP)
+	account.POST("/totp/confirm", server.ConfirmTOTP)
+	account.DELETE("/totp", server.DisableTOTP)
+	account.GET("/oidc", server.GetIdentities)
+	account.POST("/oidc/:provider", server.LinkOIDC)
+	account.POST("/oidc/link/callback", server.LinkOIDCCallback)
+	account.DELETE("/oidc/:provider", server.UnlinkOIDC)
+	account.POST("/logout", server.Logout)
+	account.GET("/sessions", server.GetSessions)
+	account.DELETE("/sessions", server.RevokeSession)
+	account.POST("/tokens", server.CreateAPIToken)
+	account.GET("/tokens", server.GetAPITokens)
+	account.DELETE("/tokens", server.RevokeAPIToken)
+	account.DELETE("/user", server.DeleteUser)
+	account.GET("/user/deletion", server.GetPendingDeletion)
+	account.DELETE("/user/deletion", server.CancelDeletion)
+	account.POST("/settings", server.UpdateSettings)
+
+	// checks the scopes for each kind of data requested
 	auth.POST("/user", server.UserInfo)
-	auth.DELETE("/user", server.DeleteUser)
-	auth.POST("/settings", server.UpdateSettings)
 
-	auth.POST("/workout", server.CreateWorkout)
-	auth.DELETE("/workout", server.DeleteWorkout)
+	workouts := auth.Group("", RequireScope("workouts"))
+	workouts.POST("/workout", server.CreateWorkout)
+	workouts.DELETE("/workout", server.DeleteWorkout)
+
+	period := auth.Group("", RequireScope("period"))
+	period.POST("/period", server.MarkPeriod)
+
+	weight := auth.Group("", RequireScope("weight"))
+	weight.POST("/weight", server.SetWeight)
 
-	auth.POST("/period", server.MarkPeriod)
+	food := auth.Group("", RequireScope("food"))
+	food.POST("/food", server.CreateFood)
+	food.PUT("/food", server.UpdateFood)
+	food.DELETE("/food", server.DeleteFood)
+	food.GET("/food/search", server.FindFood)
+	food.GET("/food/id", server.GetFoodByID)
+	food.GET("/food/barcode", server.FindFoodByBarcode)
+	food.GET("/food/suggestions", server.SuggestFoods)
+	food.GET("/nutrients", server.GetNutrients)
+	food.GET("/recipe", server.GetRecipes)
+	food.POST("/recipe", server.CreateRecipe)
+	food.PUT("/recipe", server.UpdateRecipe)
+	food.DELETE("/recipe", server.DeleteRecipe)
 
-	auth.POST("/weight", server.SetWeight)
+	meals := auth.Group("", RequireScope("meals"))
+	meals.POST("/meal/date", server.CreateFoodLog)
+	meals.GET("/meal/date", server.GetFoodLogs)
+	meals.POST("/meal", server.CreateMeal)
+	meals.PUT("/meal", server.UpdateMeal)
+	meals.DELETE("/meal", server.DeleteMeal)
+	meals.POST("/meal/copy", server.CopyMeal)
+	meals.POST("/meal/repeat", server.RepeatMeal)
+	meals.POST("/meal/move", server.MoveMeal)
+	meals.GET("/nutrition", server.GetNutrition)
+	meals.POST("/recipe/log", server.LogRecipe)
+	meals.GET("/meal/schedule", server.GetSchedule)
+	meals.PUT("/meal/schedule", server.SetSchedule)
+	meals.DELETE("/meal/schedule", server.DeleteScheduledMeal)
 
-	auth.POST("/food", server.CreateFood)
-	auth.GET("/food/search", server.FindFood)
-	auth.GET("/food/id", server.GetFoodByID)
+	goals := auth.Group("", RequireScope("goals"))
+	goals.GET("/goals", server.GetGoals)
+	goals.POST("/goals", server.SetGoals)
 
-	auth.POST("/meal/date", server.CreateFoodLog)
-	auth.POST("/meal", server.CreateMeal)
-	auth.DELETE("/meal", server.DeleteMeal)
+	go server.RunDeletionJob()
 
 	r.Run("0.0.0.0:8080")
 	server.Cleanup()
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+var errSlotNotFound = errors.New("Meal slot not found")
+
+// the id of the top level meal named slot in the day's log. days that
+// haven't been logged yet, or whose log was deleted, are started from
+// the user's schedule first
+func getSlotMeal(s *Server, tx pgx.Tx, user *User, date, slot string) (uint, error) {
+	var mealIDs []uint
+	var deleted bool
+	sql := `
+		select MealIDs, Deleted from DailyFoodLogs
+		where UserID = $1 and Date = $2 for update;`
+	err := tx.QueryRow(s.ctx, sql, user.ID, date).Scan(&mealIDs, &deleted)
+	missing := errors.Is(err, pgx.ErrNoRows)
+	if err != nil && !missing {
+		return 0, err
+	}
+
+	if missing || deleted {
+		meals, err := scheduledMeals(s, user)
+		if err != nil {
+			return 0, err
+		}
+		if missing {
+			meals, err = createFoodLog(s, tx, user.ID, date, meals)
+		} else {
+			meals, err = restoreFoodLog(s, tx, user.ID, date, meals)
+		}
+		if err != nil {
+			return 0, err
+		}
+		mealIDs = []uint{}
+		for _, meal := range meals {
+			mealIDs = append(mealIDs, meal.ID)
+		}
+	}
+
+	var id uint
+	sql = `
+		select ID from Meals
+		where ID = any($1) and UserID = $2 and Name = $3 and Deleted = false
+		order by ID limit 1;`
+	err = tx.QueryRow(s.ctx, sql, mealIDs, user.ID, slot).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, errSlotNotFound
+	}
+	return id, err
+}
+
+type CopyMealRequest struct {
+	MealID uint   `json:"mealID"`
+	Slot   string `json:"slot,omitempty"` // where to copy it, the meal's own slot by default
+
+	Date string `json:"date,omitempty"` // for copying
+	From string `json:"from,omitempty"` // for repeating
+	To   string `json:"to,omitempty"`
+}
+
+// copy the meal and everything below it into the slot of every date,
+// all or nothing. copying a slot copies what's been logged in it
+func copyMealToDays(c *gin.Context, s *Server, req CopyMealRequest, dates []time.Time) {
+	user := c.MustGet("user").(*User)
+
+	trees, err := getMealTrees(s, user.ID, []uint{req.MealID})
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't copy meal"})
+		return
+	}
+	if len(trees) == 0 {
+		c.JSON(StatusBadRequest, gin.H{"error": "Meal not found"})
+		return
+	}
+
+	source := trees[0]
+	copies := []Meal{source}
+	if source.ParentID == 0 {
+		copies = source.Children
+		if req.Slot == "" {
+			req.Slot = source.Name
+		}
+	}
+	if req.Slot == "" {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't copy meal"})
+		return
+	}
+	defer tx.Rollback(s.ctx)
+
+	created := []Meal{}
+	for _, date := range dates {
+		slotID, err := getSlotMeal(s, tx, user, date.Format(logDateLayout), req.Slot)
+		if errors.Is(err, errSlotNotFound) {
+			c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't copy meal"})
+			return
+		}
+
+		for _, meal := range copies {
+			meal = copyMeal(meal)
+			meal.ParentID = slotID
+			meal, err = createMeal(s, tx, meal, user.ID, slotID)
+			if err != nil {
+				c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't copy meal"})
+				return
+			}
+			created = append(created, meal)
+		}
+	}
+
+	if err := tx.Commit(s.ctx); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't copy meal"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"updatedMeals": created})
+}
+
+// api endpoints
+func (s *Server) CopyMeal(c *gin.Context) {
+	var req CopyMealRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	date, err := parseLogDate(req.Date)
+	if err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid date"})
+		return
+	}
+
+	copyMealToDays(c, s, req, []time.Time{date})
+}
+
+// copy the meal into every day from the request's from to to
+func (s *Server) RepeatMeal(c *gin.Context) {
+	var req CopyMealRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	dates, err := logDateRange(req.From, req.To)
+	if err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	copyMealToDays(c, s, req, dates)
+}
+
+type MoveMealRequest struct {
+	MealID   uint `json:"mealID"`
+	ParentID uint `json:"parentID"` // the slot, or meal, to move it into
+}
+
+// move a food, or a meal, into another slot, which can be on another day
+func (s *Server) MoveMeal(c *gin.Context) {
+	var req MoveMealRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := c.MustGet("user").(*User)
+
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't move meal"})
+		return
+	}
+	defer tx.Rollback(s.ctx)
+
+	var parentID uint
+	sql := "select ParentID from Meals where ID = $1 and UserID = $2 and Deleted = false for update;"
+	err = tx.QueryRow(s.ctx, sql, req.MealID, user.ID).Scan(&parentID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(StatusBadRequest, gin.H{"error": "Meal not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't move meal"})
+		return
+	}
+	if parentID == 0 {
+		c.JSON(StatusBadRequest, gin.H{"error": "Meal slots can't be moved"})
+		return
+	}
+
+	valid, err := validParent(s, tx, user.ID, req.MealID, req.ParentID)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't move meal"})
+		return
+	}
+	if !valid {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid parent meal"})
+		return
+	}
+
+	sql = "update Meals set ParentID = $1, LastModified = $2 where ID = $3;"
+	_, err = tx.Exec(s.ctx, sql, req.ParentID, time.Now(), req.MealID)
+	if err == nil {
+		err = tx.Commit(s.ctx)
+	}
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't move meal"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// an entry in the nutrient catalog, which lives in the Nutrients table.
+// foods store their amounts per 1 g in FoodNutrients, keyed by Code
+type Nutrient struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	Unit string `json:"unit"`
+}
+
+func getNutrients(s *Server) ([]Nutrient, error) {
+	scanNutrient := func(rows pgx.Rows) (Nutrient, error) {
+		var n Nutrient
+		err := rows.Scan(&n.Code, &n.Name, &n.Unit)
+		return n, err
+	}
+
+	sql := "select Code, Name, Unit from Nutrients order by Position;"
+	return fetchRows(s, sql, scanNutrient)
+}
+
+// make sure every nutrient is in the catalog and has a sensible amount
+func validateNutrients(s *Server, nutrients map[string]float64) error {
+	catalog, err := getNutrients(s)
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, n := range catalog {
+		known[n.Code] = true
+	}
+
+	for code, amount := range nutrients {
+		if !known[code] {
+			return fmt.Errorf("Unknown nutrient %s", code)
+		}
+		if amount < 0 || math.IsNaN(amount) || math.IsInf(amount, 0) {
+			return fmt.Errorf("Invalid amount of %s", code)
+		}
+	}
+	return nil
+}
+
+// split the nutrients, or portions, into arrays to pass to unnest
+func nutrientArrays(nutrients map[string]float64) ([]string, []float64) {
+	codes := []string{}
+	amounts := []float64{}
+	for code, amount := range nutrients {
+		codes = append(codes, code)
+		amounts = append(amounts, amount)
+	}
+	return codes, amounts
+}
+
+// api endpoints
+func (s *Server) GetNutrients(c *gin.Context) {
+	nutrients, err := getNutrients(s)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't get nutrients"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"nutrients": nutrients})
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// nutrient code -> amount, in the unit from the nutrient catalog
+type NutritionTotals map[string]float64
+
+func (t NutritionTotals) add(other NutritionTotals) {
+	for code, amount := range other {
+		t[code] += amount
+	}
+}
+
+type DayNutrition struct {
+	Date   string                   `json:"date"`
+	Totals NutritionTotals          `json:"totals"`
+	Meals  map[uint]NutritionTotals `json:"meals"` // every meal in the day's tree
+	Goals  []GoalProgress           `json:"goals"`
+}
+
+type NutritionReport struct {
+	Days   []DayNutrition  `json:"days"`
+	Totals NutritionTotals `json:"totals"`
+	// meals whose serving unit couldn't be converted to grams, so they're left out
+	Unconverted []uint `json:"unconverted"`
+}
+
+// the dates are formatted like the frontend formats them, e.g. "January 2, 2006"
+const logDateLayout = "January 2, 2006"
+
+func parseLogDate(date string) (time.Time, error) {
+	return time.Parse(logDateLayout, date)
+}
+
+// every day from the first date to the last, at most a year or so.
+// the errors are meant for the client
+func logDateRange(from, to string) ([]time.Time, error) {
+	start, startErr := parseLogDate(from)
+	end, endErr := parseLogDate(to)
+	if startErr != nil || endErr != nil || end.Before(start) {
+		return nil, errors.New("Invalid dates")
+	}
+	if end.Sub(start) > 366*24*time.Hour {
+		return nil, errors.New("Date range is too long")
+	}
+
+	dates := []time.Time{}
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		dates = append(dates, day)
+	}
+	return dates, nil
+}
+
+// a node of a day's meal tree
+type mealNode struct {
+	Date        string
+	ID          uint
+	ParentID    uint
+	FoodID      uint
+	Servings    float64
+	ServingSize float64
+	ServingUnit string
+}
+
+// walk the meal trees of the days with a recursive query, then total
+// each meal's food along with everything below it
+func getNutrition(s *Server, userID uint, dates []time.Time) (NutritionReport, error) {
+	formatted := []string{}
+	for _, date := range dates {
+		formatted = append(formatted, date.Format(logDateLayout))
+	}
+
+	scanNode := func(rows pgx.Rows) (mealNode, error) {
+		var n mealNode
+		err := rows.Scan(&n.Date, &n.ID, &n.ParentID, &n.FoodID,
+			&n.Servings, &n.ServingSize, &n.ServingUnit)
+		return n, err
+	}
+
+	sql := `
+		with recursive tree as (
+			select DailyFoodLogs.Date, Meals.ID, 0 as ParentID, Meals.FoodID,
+			       Meals.Servings, Meals.ServingSize, Meals.ServingUnit
+			from DailyFoodLogs
+			join Meals on Meals.ID = any(DailyFoodLogs.MealIDs)
+			where DailyFoodLogs.UserID = $1 and DailyFoodLogs.Deleted = false
+			and DailyFoodLogs.Date = any($2) and Meals.UserID = $1 and Meals.Deleted = false
+			union all
+			select tree.Date, Meals.ID, Meals.ParentID, Meals.FoodID,
+			       Meals.Servings, Meals.ServingSize, Meals.ServingUnit
+			from Meals join tree on Meals.ParentID = tree.ID
+			where Meals.UserID = $1 and Meals.Deleted = false
+		)
+		select Date, ID, ParentID, FoodID, Servings, ServingSize, ServingUnit from tree;`
+	nodes, err := fetchRows(s, sql, scanNode, userID, formatted)
+	if err != nil {
+		return NutritionReport{}, err
+	}
+
+	foodIDs := []uint{}
+	for _, node := range nodes {
+		if node.FoodID != 0 {
+			foodIDs = append(foodIDs, node.FoodID)
+		}
+	}
+	nutrients, err := getFoodNutrients(s, foodIDs)
+	if err != nil {
+		return NutritionReport{}, err
+	}
+	units, err := getFoodUnits(s, foodIDs)
+	if err != nil {
+		return NutritionReport{}, err
+	}
+
+	goals, err := getGoalHistory(s, userID, dates[len(dates)-1])
+	if err != nil {
+		return NutritionReport{}, err
+	}
+
+	report := NutritionReport{Totals: NutritionTotals{}, Unconverted: []uint{}}
+	days := map[string]*DayNutrition{}
+	for _, date := range formatted {
+		day := &DayNutrition{Date: date, Totals: NutritionTotals{}, Meals: map[uint]NutritionTotals{}}
+		days[date] = day
+	}
+
+	// the totals of a meal's own food
+	own := map[uint]NutritionTotals{}
+	children := map[uint][]uint{}
+	for _, node := range nodes {
+		children[node.ParentID] = append(children[node.ParentID], node.ID)
+		own[node.ID] = NutritionTotals{}
+		if node.FoodID == 0 {
+			continue
+		}
+
+		grams, err := units[node.FoodID].servingGrams(
+			node.Servings, node.ServingSize, node.ServingUnit)
+		if err != nil {
+			report.Unconverted = append(report.Unconverted, node.ID)
+			continue
+		}
+		for code, perGram := range nutrients[node.FoodID] {
+			own[node.ID][code] = perGram * grams
+		}
+	}
+
+	var total func(day *DayNutrition, id uint) NutritionTotals
+	total = func(day *DayNutrition, id uint) NutritionTotals {
+		totals := NutritionTotals{}
+		totals.add(own[id])
+		for _, child := range children[id] {
+			totals.add(total(day, child))
+		}
+		day.Meals[id] = totals
+		return totals
+	}
+
+	for _, node := range nodes {
+		if node.ParentID == 0 {
+			day := days[node.Date]
+			day.Totals.add(total(day, node.ID))
+		}
+	}
+
+	for i, date := range formatted {
+		day := days[date]
+		day.Goals = goalProgress(goalsOn(goals, dates[i]), day.Totals)
+		report.Days = append(report.Days, *day)
+		report.Totals.add(day.Totals)
+	}
+	return report, nil
+}
+
+// fill in the totals and goal progress of the logs, so that
+// clients don't need to ask for the nutrition of the same days
+func addLogNutrition(s *Server, userID uint, logs []DailyFoodLog) error {
+	dates := []time.Time{}
+	for _, l := range logs {
+		if date, err := parseLogDate(l.Date); err == nil && !l.Deleted {
+			dates = append(dates, date)
+		}
+	}
+	if len(dates) == 0 {
+		return nil
+	}
+	slices.SortFunc(dates, func(a, b time.Time) int { return a.Compare(b) })
+
+	report, err := getNutrition(s, userID, dates)
+	if err != nil {
+		return err
+	}
+	days := map[string]DayNutrition{}
+	for _, day := range report.Days {
+		days[day.Date] = day
+	}
+
+	for i := range logs {
+		if day, exists := days[logs[i].Date]; exists && !logs[i].Deleted {
+			logs[i].Totals = day.Totals
+			logs[i].Goals = day.Goals
+		}
+	}
+	return nil
+}
+
+// food id -> nutrient code -> amount per 1 g
+func getFoodNutrients(s *Server, foodIDs []uint) (map[uint]NutritionTotals, error) {
+	type foodNutrient struct {
+		FoodID uint
+		Code   string
+		Amount float64
+	}
+	scanNutrient := func(rows pgx.Rows) (foodNutrient, error) {
+		var n foodNutrient
+		err := rows.Scan(&n.FoodID, &n.Code, &n.Amount)
+		return n, err
+	}
+
+	sql := "select FoodID, Code, Amount from FoodNutrients where FoodID = any($1);"
+	rows, err := fetchRows(s, sql, scanNutrient, foodIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	nutrients := map[uint]NutritionTotals{}
+	for _, n := range rows {
+		if nutrients[n.FoodID] == nil {
+			nutrients[n.FoodID] = NutritionTotals{}
+		}
+		nutrients[n.FoodID][n.Code] = n.Amount
+	}
+	return nutrients, nil
+}
+
+// api endpoints
+
+// totals for a single ?date= or every day from ?from= to ?to=
+func (s *Server) GetNutrition(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	from, to := c.Query("from"), c.Query("to")
+	if date, exists := c.GetQuery("date"); exists {
+		from, to = date, date
+	}
+
+	dates, err := logDateRange(from, to)
+	if err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	report, err := getNutrition(s, user.ID, dates)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't total nutrition"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"nutrition": report})
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+const oidcStateLifetime = 10 * time.Minute
+
+// an openid connect provider we let users sign in with, using the
+// authorization code flow with PKCE. the provider redirects back to
+// the app, which hands the code and state to OIDCCallback
+type OIDCProvider struct {
+	config OIDCProviderConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]any
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified any    `json:"email_verified"` // some providers send a string
+}
+
+func newOIDCProviders(config Config) map[string]*OIDCProvider {
+	providers := map[string]*OIDCProvider{}
+	for _, c := range config.OIDCProviders {
+		providers[c.Name] = &OIDCProvider{
+			config: c, client: &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+	return providers
+}
+
+func (p *OIDCProvider) getJSON(url string, value any) error {
+	response, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(value)
+}
+
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	url := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(url, &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("issuer mismatch: %s", discovery.Issuer)
+	}
+
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// find the key the id token was signed with, refetching
+// the provider's keys when it has rotated to a new one
+func (p *OIDCProvider) key(kid string) (any, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, exists := p.keys[kid]; exists {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := p.getJSON(discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	p.keys = map[string]any{}
+	for _, jwk := range set.Keys {
+		if key, err := parseJWK(jwk); err == nil {
+			p.keys[jwk.Kid] = key
+		}
+	}
+
+	key, exists := p.keys[kid]
+	if !exists {
+		return nil, fmt.Errorf("unknown key id: %s", kid)
+	}
+	return key, nil
+}
+
+func parseJWK(jwk JWK) (any, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve: %s", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %s", jwk.Kty)
+}
+
+func (p *OIDCProvider) authURL(state, nonce, verifier string) (string, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.config.ClientID)
+	params.Set("redirect_uri", p.config.RedirectURL)
+	params.Set("scope", "openid email")
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+	return discovery.AuthorizationEndpoint + "?" + params.Encode(), nil
+}
+
+// exchange the authorization code for an id token
+func (p *OIDCProvider) exchange(code, verifier string) (string, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", verifier)
+	if p.config.ClientSecret == "" { // public client
+		form.Set("client_id", p.config.ClientID)
+	}
+
+	request, err := http.NewRequest("POST", discovery.TokenEndpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(p.config.ClientID),
+			url.QueryEscape(p.config.ClientSecret))
+	}
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return "", fmt.Errorf("token endpoint returned %s: %s", response.Status, body)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("no id token in response")
+	}
+	return tokens.IDToken, nil
+}
+
+func (p *OIDCProvider) verifyIDToken(rawToken string, nonce string) (*idTokenClaims, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	var claims idTokenClaims
+	_, err = jwt.ParseWithClaims(rawToken, &claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "ES256"}),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Nonce != nonce || claims.Subject == "" {
+		return nil, errors.New("invalid id token")
+	}
+	return &claims, nil
+}
+
+func (c *idTokenClaims) emailVerified() bool {
+	return c.EmailVerified == true || c.EmailVerified == "true"
+}
+
+// remember what we need to finish the flow once the provider redirects back.
+// userID is set when a logged in user is linking another way to sign in
+func createOIDCState(s *Server, provider string, userID uint) (string, string, string, error) {
+	state, _, err := createRandomToken()
+	if err != nil {
+		return "", "", "", err
+	}
+	nonce, _, err := createRandomToken()
+	if err != nil {
+		return "", "", "", err
+	}
+	verifier, _, err := createRandomToken()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	sql := `
+		insert into OIDCStates
+		(State, LastModified, Provider, UserID, Nonce, Verifier, ExpiresAt)
+		values ($1, $2, $3, $4, $5, $6, $7);`
+	now := time.Now()
+	_, err = s.db.Exec(s.ctx, sql, hashToken(state), now, provider, userID,
+		nonce, verifier, now.Add(oidcStateLifetime))
+	return state, nonce, verifier, err
+}
+
+type oidcState struct {
+	Provider string
+	UserID   uint
+	Nonce    string
+	Verifier string
+}
+
+var errInvalidOIDCState = errors.New("invalid or expired state")
+
+func consumeOIDCState(s *Server, state string) (oidcState, error) {
+	sql := `
+		delete from OIDCStates where State = $1 and ExpiresAt > $2
+		returning Provider, UserID, Nonce, Verifier;`
+	var o oidcState
+	err := s.db.QueryRow(s.ctx, sql, hashToken(state), time.Now()).Scan(
+		&o.Provider, &o.UserID, &o.Nonce, &o.Verifier)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return o, errInvalidOIDCState
+	}
+	return o, err
+}
+
+// returns 0 if nobody has linked the identity yet
+func getIdentityUser(s *Server, provider, subject string) (uint, error) {
+	sql := `
+		select Identities.UserID from Identities
+		join Users on Users.ID = Identities.UserID
+		where Provider = $1 and Subject = $2 and Users.Deleted = false;`
+	var userID uint
+	err := s.db.QueryRow(s.ctx, sql, provider, subject).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	return userID, err
+}
+
+func linkIdentity(s *Server, userID uint, provider string, claims *idTokenClaims) error {
+	sql := `
+		insert into Identities (LastModified, UserID, Provider, Subject, Email)
+		values ($1, $2, $3, $4, $5);`
+	_, err := s.db.Exec(s.ctx, sql, time.Now(), userID, provider,
+		claims.Subject, claims.Email)
+	return err
+}
+
+// find the user the identity belongs to, creating or linking one if needed
+func userFromIdentity(s *Server, provider string, claims *idTokenClaims) (*User, error) {
+	userID, err := getIdentityUser(s, provider, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if userID != 0 {
+		return getUser(s, "ID", userID)
+	}
+
+	if claims.Email == "" || !claims.emailVerified() {
+		return nil, errors.New("the provider didn't share a verified email")
+	}
+
+	existing, err := getUser(s, "Email", claims.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	// only link to an existing account when both sides have verified
+	// the address, otherwise anyone could sign up at the provider with
+	// someone else's email and take over their account
+	if existing != nil {
+		if !existing.EmailVerified {
+			return nil, errors.New("an account with this email already exists")
+		}
+		return existing, linkIdentity(s, existing.ID, provider, claims)
+	}
+
+	userID, err = createUser(s, claims.Email, "")
+	if err != nil {
+		return nil, err
+	}
+
+	sql := "update Users set EmailVerified = true where ID = $1;"
+	if _, err := s.db.Exec(s.ctx, sql, userID); err != nil {
+		return nil, err
+	}
+
+	if err := linkIdentity(s, userID, provider, claims); err != nil {
+		return nil, err
+	}
+	return getUser(s, "ID", userID)
+}
+
+// api endpoints
+type OIDCRequest struct {
+	State string `json:"state"`
+	Code  string `json:"code"`
+}
+
+type Identity struct {
+	Provider string `json:"provider"`
+	Email    string `json:"email"`
+}
+
+func startOIDC(c *gin.Context, s *Server, userID uint) {
+	name := c.Param("provider")
+	provider, exists := s.oidc[name]
+	if !exists {
+		c.JSON(StatusBadRequest, gin.H{"error": "Unknown provider"})
+		return
+	}
+
+	state, nonce, verifier, err := createOIDCState(s, name, userID)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't start sign in"})
+		return
+	}
+
+	url, err := provider.authURL(state, nonce, verifier)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't reach provider"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"url": url, "state": state})
+}
+
+func (s *Server) GetOIDCProviders(c *gin.Context) {
+	names := []string{}
+	for _, provider := range s.config.OIDCProviders {
+		names = append(names, provider.Name)
+	}
+	c.JSON(StatusOK, gin.H{"providers": names})
+}
+
+func (s *Server) StartOIDC(c *gin.Context) { startOIDC(c, s, 0) }
+
+func (s *Server) LinkOIDC(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+	startOIDC(c, s, user.ID)
+}
+
+// check the state and trade the code for the user's claims. userID is
+// who's finishing the flow, 0 when nobody's signed in. a link can only
+// be finished by the user who started it, otherwise someone could get
+// a victim to link their identity into the attacker's account
+func finishOIDC(c *gin.Context, s *Server, userID uint) (*idTokenClaims, string, bool) {
+	var req OIDCRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, "", false
+	}
+
+	state, err := consumeOIDCState(s, req.State)
+	if errors.Is(err, errInvalidOIDCState) {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid or expired state"})
+		return nil, "", false
+	} else if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't query database"})
+		return nil, "", false
+	}
+	if state.UserID != userID {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid or expired state"})
+		return nil, "", false
+	}
+
+	provider, exists := s.oidc[state.Provider]
+	if !exists {
+		c.JSON(StatusBadRequest, gin.H{"error": "Unknown provider"})
+		return nil, "", false
+	}
+
+	idToken, err := provider.exchange(req.Code, state.Verifier)
+	if err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": "Couldn't exchange code"})
+		return nil, "", false
+	}
+
+	claims, err := provider.verifyIDToken(idToken, state.Nonce)
+	if err != nil {
+		c.JSON(StatusUnauthorized, gin.H{"error": "Invalid id token"})
+		return nil, "", false
+	}
+	return claims, state.Provider, true
+}
+
+func (s *Server) OIDCCallback(c *gin.Context) {
+	claims, provider, ok := finishOIDC(c, s, 0)
+	if !ok {
+		return
+	}
+
+	user, err := userFromIdentity(s, provider, claims)
+	if err != nil || user == nil {
+		c.JSON(StatusBadRequest, gin.H{"error": "Couldn't sign in"})
+		return
+	}
+
+	issueTokens(c, s, user)
+}
+
+// finishes linking, for the signed in user who started it with LinkOIDC
+func (s *Server) LinkOIDCCallback(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+	claims, provider, ok := finishOIDC(c, s, user.ID)
+	if !ok {
+		return
+	}
+
+	linkedTo, err := getIdentityUser(s, provider, claims.Subject)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't query database"})
+		return
+	}
+	if linkedTo != 0 {
+		c.JSON(StatusBadRequest, gin.H{"error": "Already linked to an account"})
+		return
+	}
+
+	if err := linkIdentity(s, user.ID, provider, claims); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't link account"})
+		return
+	}
+	c.JSON(StatusOK, gin.H{})
+}
+
+func (s *Server) GetIdentities(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	scanIdentity := func(rows pgx.Rows) (Identity, error) {
+		var i Identity
+		err := rows.Scan(&i.Provider, &i.Email)
+		return i, err
+	}
+
+	sql := "select Provider, Email from Identities where UserID = $1;"
+	identities, err := fetchRows(s, sql, scanIdentity, user.ID)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't get linked accounts"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"identities": identities})
+}
+
+func (s *Server) UnlinkOIDC(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	// don't leave the user without any way to sign in
+	var others int
+	sql := "select count(*) from Identities where UserID = $1 and Provider != $2;"
+	err := s.db.QueryRow(s.ctx, sql, user.ID, c.Param("provider")).Scan(&others)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't query database"})
+		return
+	}
+	if others == 0 && user.Password == "" {
+		c.JSON(StatusBadRequest, gin.H{"error": "Set a password before unlinking"})
+		return
+	}
+
+	sql = "delete from Identities where UserID = $1 and Provider = $2;"
+	if _, err := s.db.Exec(s.ctx, sql, user.ID, c.Param("provider")); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't unlink account"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
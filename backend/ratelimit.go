@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// token bucket rate limiting, where every key gets its own bucket
+type RateLimiter interface {
+	// take a token from the key's bucket. returns how long
+	// to wait before trying again if the bucket is empty
+	Take(key string) (time.Duration, error)
+}
+
+func newRateLimiter(s *Server, name string, perMinute, burst int) RateLimiter {
+	rate := float64(perMinute) / 60
+	if s.config.RateLimitStore == "postgres" {
+		return &PostgresLimiter{
+			db: s.db, ctx: s.ctx, name: name, rate: rate, burst: float64(burst)}
+	}
+	return &MemoryLimiter{rate: rate, burst: float64(burst), buckets: map[string]*bucket{}}
+}
+
+// refill the bucket for the time that has passed, then try to take a token
+func takeToken(tokens float64, elapsed time.Duration, rate, burst float64) (float64, time.Duration) {
+	tokens = math.Min(burst, tokens+elapsed.Seconds()*rate)
+	if tokens >= 1 {
+		return tokens - 1, 0
+	}
+	wait := time.Duration((1 - tokens) / rate * float64(time.Second))
+	return tokens, wait
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// keeps the buckets in memory, only suitable for a single replica
+type MemoryLimiter struct {
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*bucket
+	mu      sync.Mutex
+}
+
+func (l *MemoryLimiter) Take(key string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.buckets) > 10000 {
+		l.sweep(now)
+	}
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+
+	var wait time.Duration
+	b.tokens, wait = takeToken(b.tokens, now.Sub(b.updated), l.rate, l.burst)
+	b.updated = now
+	return wait, nil
+}
+
+// forget the buckets that would have refilled by now
+func (l *MemoryLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// keeps the buckets in the database, so they're shared between replicas
+type PostgresLimiter struct {
+	db    *pgxpool.Pool
+	ctx   context.Context
+	name  string
+	rate  float64 // tokens per second
+	burst float64
+}
+
+func (l *PostgresLimiter) Take(key string) (time.Duration, error) {
+	tx, err := l.db.Begin(l.ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(l.ctx)
+
+	now := time.Now()
+	key = fmt.Sprintf("%s:%s", l.name, key)
+
+	sql := `
+		insert into RateLimits (Key, Tokens, LastModified) values ($1, $2, $3)
+		on conflict(Key) do nothing;`
+	if _, err := tx.Exec(l.ctx, sql, key, l.burst, now); err != nil {
+		return 0, err
+	}
+
+	var tokens float64
+	var updated time.Time
+	sql = "select Tokens, LastModified from RateLimits where Key = $1 for update;"
+	if err := tx.QueryRow(l.ctx, sql, key).Scan(&tokens, &updated); err != nil {
+		return 0, err
+	}
+
+	tokens, wait := takeToken(tokens, now.Sub(updated), l.rate, l.burst)
+	sql = "update RateLimits set Tokens = $1, LastModified = $2 where Key = $3;"
+	if _, err := tx.Exec(l.ctx, sql, tokens, now, key); err != nil {
+		return 0, err
+	}
+
+	return wait, tx.Commit(l.ctx)
+}
+
+func tooManyRequests(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+	c.AbortWithStatusJSON(StatusTooManyRequests,
+		gin.H{"error": "Too many attempts, try again later"})
+}
+
+// limit how often a single ip address can call the route
+func RateLimitMiddleware(limiter RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		wait, err := limiter.Take(c.ClientIP())
+		if err != nil {
+			c.AbortWithStatusJSON(StatusInternalServerError,
+				gin.H{"error": "Couldn't check rate limit"})
+			return
+		}
+
+		if wait > 0 {
+			tooManyRequests(c, wait)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// failed logins are tracked per email address rather than per user,
+// so that addresses without an account get locked out just the same
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// how much longer logging in with the email is locked for
+func loginLockedFor(s *Server, email string) (time.Duration, error) {
+	var lockedUntil time.Time
+	sql := "select LockedUntil from LoginFailures where Email = $1;"
+	err := s.db.QueryRow(s.ctx, sql, normalizeEmail(email)).Scan(&lockedUntil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return max(0, time.Until(lockedUntil)), nil
+}
+
+// once the failures reach the threshold, every following failure
+// doubles the lockout, up to a day
+func lockoutDuration(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	lockout := time.Minute << min(failures-threshold, 11)
+	return min(lockout, 24*time.Hour)
+}
+
+func recordLoginFailure(s *Server, email string) error {
+	sql := `
+		insert into LoginFailures (Email, Failures, LockedUntil, LastModified)
+		values ($1, 1, $2, $2)
+		on conflict(Email) do update
+		set Failures = LoginFailures.Failures + 1, LastModified = excluded.LastModified
+		returning Failures;`
+
+	now := time.Now()
+	email = normalizeEmail(email)
+
+	var failures int
+	if err := s.db.QueryRow(s.ctx, sql, email, now).Scan(&failures); err != nil {
+		return err
+	}
+
+	lockout := lockoutDuration(failures, s.config.LockoutThreshold)
+	if lockout == 0 {
+		return nil
+	}
+
+	sql = "update LoginFailures set LockedUntil = $1 where Email = $2;"
+	_, err := s.db.Exec(s.ctx, sql, now.Add(lockout), email)
+	return err
+}
+
+func clearLoginFailures(s *Server, email string) error {
+	sql := "delete from LoginFailures where Email = $1;"
+	_, err := s.db.Exec(s.ctx, sql, normalizeEmail(email))
+	return err
+}
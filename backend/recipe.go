@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// a dish the user cooks often, made of foods. logging a recipe
+// turns it into a meal with an ingredient meal per food
+type Recipe struct {
+	ID          uint         `json:"id,omitempty"`
+	Name        string       `json:"name"`
+	Yield       float64      `json:"yield"` // how many servings the recipe makes
+	Ingredients []Ingredient `json:"ingredients"`
+
+	PerServing  NutritionTotals `json:"perServing,omitempty"`
+	Unconverted []uint          `json:"unconverted,omitempty"` // ingredient foods left out of PerServing
+}
+
+type Ingredient struct {
+	FoodID uint    `json:"foodID"`
+	Name   string  `json:"name,omitempty"` // the food's name
+	Amount float64 `json:"amount"`
+	Unit   string  `json:"unit"`
+}
+
+func getRecipes(s *Server, userID uint, recipeID uint) ([]Recipe, error) {
+	scanRecipe := func(rows pgx.Rows) (Recipe, error) {
+		var r Recipe
+		err := rows.Scan(&r.ID, &r.Name, &r.Yield)
+		r.Ingredients = []Ingredient{}
+		return r, err
+	}
+
+	// every recipe when recipeID is 0
+	sql := `
+		select ID, Name, Yield from Recipes
+		where UserID = $1 and Deleted = false and ($2 = 0 or ID = $2)
+		order by Name;`
+	recipes, err := fetchRows(s, sql, scanRecipe, userID, recipeID)
+	if err != nil || len(recipes) == 0 {
+		return recipes, err
+	}
+
+	type recipeIngredient struct {
+		RecipeID uint
+		Ingredient
+	}
+	scanIngredient := func(rows pgx.Rows) (recipeIngredient, error) {
+		var i recipeIngredient
+		err := rows.Scan(&i.RecipeID, &i.FoodID, &i.Name, &i.Amount, &i.Unit)
+		return i, err
+	}
+
+	ids := []uint{}
+	for _, r := range recipes {
+		ids = append(ids, r.ID)
+	}
+	sql = `
+		select RecipeIngredients.RecipeID, RecipeIngredients.FoodID, Foods.Name,
+		       RecipeIngredients.Amount, RecipeIngredients.Unit
+		from RecipeIngredients join Foods on Foods.ID = RecipeIngredients.FoodID
+		where RecipeIngredients.RecipeID = any($1)
+		order by RecipeIngredients.RecipeID, RecipeIngredients.Position;`
+	ingredients, err := fetchRows(s, sql, scanIngredient, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	index := map[uint]int{}
+	for i, r := range recipes {
+		index[r.ID] = i
+	}
+	for _, i := range ingredients {
+		r := &recipes[index[i.RecipeID]]
+		r.Ingredients = append(r.Ingredients, i.Ingredient)
+	}
+
+	return recipes, addRecipeNutrition(s, recipes)
+}
+
+// total each recipe's ingredients and divide by the yield
+func addRecipeNutrition(s *Server, recipes []Recipe) error {
+	foodIDs := []uint{}
+	for _, r := range recipes {
+		for _, i := range r.Ingredients {
+			foodIDs = append(foodIDs, i.FoodID)
+		}
+	}
+
+	nutrients, err := getFoodNutrients(s, foodIDs)
+	if err != nil {
+		return err
+	}
+	units, err := getFoodUnits(s, foodIDs)
+	if err != nil {
+		return err
+	}
+
+	for i := range recipes {
+		r := &recipes[i]
+		r.PerServing = NutritionTotals{}
+		for _, ingredient := range r.Ingredients {
+			grams, err := units[ingredient.FoodID].toGrams(ingredient.Amount, ingredient.Unit)
+			if err != nil {
+				r.Unconverted = append(r.Unconverted, ingredient.FoodID)
+				continue
+			}
+			for code, perGram := range nutrients[ingredient.FoodID] {
+				r.PerServing[code] += perGram * grams / r.Yield
+			}
+		}
+	}
+	return nil
+}
+
+// every ingredient has to be a food the user can see, in a unit it can be measured in
+func validateRecipe(s *Server, recipe *Recipe, userID uint) error {
+	if strings.TrimSpace(recipe.Name) == "" || recipe.Yield <= 0 || len(recipe.Ingredients) == 0 {
+		return errors.New("Invalid recipe")
+	}
+
+	foodIDs := []uint{}
+	for _, i := range recipe.Ingredients {
+		foodIDs = append(foodIDs, i.FoodID)
+	}
+
+	units, err := getVisibleFoodUnits(s, foodIDs, userID)
+	if err != nil {
+		return err
+	}
+
+	for i := range recipe.Ingredients {
+		ingredient := &recipe.Ingredients[i]
+		food, exists := units[ingredient.FoodID]
+		if !exists {
+			return fmt.Errorf("Unknown food %d", ingredient.FoodID)
+		}
+		if ingredient.Amount <= 0 {
+			return fmt.Errorf("Invalid amount of food %d", ingredient.FoodID)
+		}
+		if _, err := food.toGrams(ingredient.Amount, ingredient.Unit); err != nil {
+			return fmt.Errorf("Can't measure food %d in %s", ingredient.FoodID, ingredient.Unit)
+		}
+		ingredient.Unit = normalizeUnit(ingredient.Unit)
+	}
+	return nil
+}
+
+func insertIngredients(s *Server, tx pgx.Tx, recipeID uint, ingredients []Ingredient) error {
+	sql := `
+		insert into RecipeIngredients (RecipeID, FoodID, Amount, Unit, Position)
+		values ($1, $2, $3, $4, $5);`
+	for position, i := range ingredients {
+		if _, err := tx.Exec(s.ctx, sql, recipeID, i.FoodID, i.Amount, i.Unit, position); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// api endpoints
+func (s *Server) CreateRecipe(c *gin.Context) {
+	var req Recipe
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := c.MustGet("user").(*User)
+
+	if err := validateRecipe(s, &req, user.ID); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't create recipe"})
+		return
+	}
+	defer tx.Rollback(s.ctx)
+
+	sql := `
+		insert into Recipes (LastModified, Deleted, UserID, Name, Yield)
+		values ($1, false, $2, $3, $4) returning ID;`
+	err = tx.QueryRow(s.ctx, sql, time.Now(), user.ID, req.Name, req.Yield).Scan(&req.ID)
+	if err == nil {
+		err = insertIngredients(s, tx, req.ID, req.Ingredients)
+	}
+	if err == nil {
+		err = tx.Commit(s.ctx)
+	}
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't create recipe"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"recipeID": req.ID})
+}
+
+// replaces the recipe's name, yield and ingredients. meals it was
+// logged into before keep the ingredients they had
+func (s *Server) UpdateRecipe(c *gin.Context) {
+	var req Recipe
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := c.MustGet("user").(*User)
+
+	if err := validateRecipe(s, &req, user.ID); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't update recipe"})
+		return
+	}
+	defer tx.Rollback(s.ctx)
+
+	sql := `
+		update Recipes set LastModified = $1, Name = $2, Yield = $3
+		where ID = $4 and UserID = $5 and Deleted = false;`
+	tag, err := tx.Exec(s.ctx, sql, time.Now(), req.Name, req.Yield, req.ID, user.ID)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't update recipe"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(StatusBadRequest, gin.H{"error": "Recipe not found"})
+		return
+	}
+
+	sql = "delete from RecipeIngredients where RecipeID = $1;"
+	_, err = tx.Exec(s.ctx, sql, req.ID)
+	if err == nil {
+		err = insertIngredients(s, tx, req.ID, req.Ingredients)
+	}
+	if err == nil {
+		err = tx.Commit(s.ctx)
+	}
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't update recipe"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
+
+func (s *Server) DeleteRecipe(c *gin.Context) {
+	idStr, exists := c.GetQuery("id")
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if !exists || err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	user := c.MustGet("user").(*User)
+
+	sql := `
+		update Recipes set Deleted = true, LastModified = $1
+		where ID = $2 and UserID = $3;`
+	if _, err := s.db.Exec(s.ctx, sql, time.Now(), id, user.ID); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't delete recipe"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
+
+// a single ?id= or every recipe the user has
+func (s *Server) GetRecipes(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	var id uint64
+	if idStr, exists := c.GetQuery("id"); exists {
+		var err error
+		id, err = strconv.ParseUint(idStr, 10, 64)
+		if err != nil || id == 0 {
+			c.JSON(StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	recipes, err := getRecipes(s, user.ID, uint(id))
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't get recipes"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"recipes": recipes})
+}
+
+type LogRecipeRequest struct {
+	RecipeID uint    `json:"recipeID"`
+	ParentID uint    `json:"parentID"` // the meal to log the recipe into
+	Servings float64 `json:"servings"`
+}
+
+// log servings of a recipe as a meal, with a child meal per ingredient
+func (s *Server) LogRecipe(c *gin.Context) {
+	var req LogRecipeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := c.MustGet("user").(*User)
+
+	// getRecipes would return every recipe for 0
+	if req.RecipeID == 0 || req.Servings <= 0 || req.ParentID == 0 {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	recipes, err := getRecipes(s, user.ID, req.RecipeID)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't log recipe"})
+		return
+	}
+	if len(recipes) == 0 {
+		c.JSON(StatusBadRequest, gin.H{"error": "Recipe not found"})
+		return
+	}
+	recipe := recipes[0]
+
+	meal := Meal{ParentID: req.ParentID, Name: recipe.Name, Children: []Meal{}}
+	for _, i := range recipe.Ingredients {
+		meal.Children = append(meal.Children, Meal{
+			FoodID: i.FoodID, Name: i.Name, Children: []Meal{},
+			Servings: req.Servings / recipe.Yield, ServingSize: i.Amount, ServingUnit: i.Unit,
+		})
+	}
+
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't log recipe"})
+		return
+	}
+	defer tx.Rollback(s.ctx)
+
+	valid, err := validParent(s, tx, user.ID, 0, req.ParentID)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't log recipe"})
+		return
+	}
+	if !valid {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid parent meal"})
+		return
+	}
+
+	meal, err = createMeal(s, tx, meal, user.ID, req.ParentID)
+	if err == nil {
+		err = tx.Commit(s.ctx)
+	}
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't log recipe"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"updatedMeal": meal})
+}
@@ -78,12 +78,6 @@ func getRecords(s *Server, recordType string, options FetchOptions) ([]Record, e
 	return records, nil
 }
 
-func deleteRecords(s *Server, userID uint) error {
-	sql := "update Records set Deleted = true, LastModified = $1 where UserID = $2;"
-	_, err := s.db.Exec(s.ctx, sql, time.Now(), userID)
-	return err
-}
-
 func (s *Server) MarkPeriod(c *gin.Context) {
 	user := c.MustGet("user").(*User)
 	date, exists := c.GetQuery("date")
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// the meals every new day's food log starts with
+var defaultScheduledMeals = []string{"Breakfast", "Lunch", "Dinner", "Snacks"}
+
+// a slot in the user's day. the names and their order are kept in
+// Users.ScheduledMeals, the default foods in ScheduledMealFoods
+type ScheduledMeal struct {
+	Name  string `json:"name"`
+	Foods []Meal `json:"foods"` // logged into the meal when a day is created from the schedule
+}
+
+func getSchedule(s *Server, user *User) ([]ScheduledMeal, error) {
+	type slotFood struct {
+		Slot string
+		Meal
+	}
+	scanFood := func(rows pgx.Rows) (slotFood, error) {
+		var f slotFood
+		err := rows.Scan(&f.Slot, &f.FoodID, &f.Name,
+			&f.Servings, &f.ServingSize, &f.ServingUnit)
+		f.Children = []Meal{}
+		return f, err
+	}
+
+	sql := `
+		select ScheduledMealFoods.Slot, ScheduledMealFoods.FoodID, Foods.Name,
+		       ScheduledMealFoods.Servings, ScheduledMealFoods.ServingSize,
+		       ScheduledMealFoods.ServingUnit
+		from ScheduledMealFoods join Foods on Foods.ID = ScheduledMealFoods.FoodID
+		where ScheduledMealFoods.UserID = $1
+		order by ScheduledMealFoods.Slot, ScheduledMealFoods.Position;`
+	foods, err := fetchRows(s, sql, scanFood, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := []ScheduledMeal{}
+	for _, name := range user.ScheduledMeals {
+		slot := ScheduledMeal{Name: name, Foods: []Meal{}}
+		for _, f := range foods {
+			if f.Slot == name {
+				slot.Foods = append(slot.Foods, f.Meal)
+			}
+		}
+		schedule = append(schedule, slot)
+	}
+	return schedule, nil
+}
+
+func validateSchedule(s *Server, schedule []ScheduledMeal, userID uint) error {
+	names := []string{}
+	for i := range schedule {
+		slot := &schedule[i]
+		slot.Name = strings.TrimSpace(slot.Name)
+		if slot.Name == "" || slices.Contains(names, slot.Name) {
+			return fmt.Errorf("Invalid meal name %q", slot.Name)
+		}
+		names = append(names, slot.Name)
+
+		for _, food := range slot.Foods {
+			if food.FoodID == 0 || len(food.Children) > 0 || food.Servings <= 0 {
+				return fmt.Errorf("Invalid food in %s", slot.Name)
+			}
+		}
+		// validated as the children of the meal they'll be logged into
+		meal := Meal{Name: slot.Name, Children: slot.Foods}
+		if err := validateMealUnits(s, &meal, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// create the day's meals from the schedule, with the default foods logged into them
+func scheduledMeals(s *Server, user *User) ([]Meal, error) {
+	schedule, err := getSchedule(s, user)
+	if err != nil {
+		return nil, err
+	}
+
+	meals := []Meal{}
+	for _, slot := range schedule {
+		meals = append(meals, Meal{Name: slot.Name, Children: slot.Foods})
+	}
+	return meals, nil
+}
+
+// copy the meals of an earlier day, skipping the ones that have been deleted
+func copiedMeals(s *Server, userID uint, date string) ([]Meal, error) {
+	var mealIDs []uint
+	sql := "select MealIDs from DailyFoodLogs where UserID = $1 and Date = $2 and Deleted = false;"
+	if err := s.db.QueryRow(s.ctx, sql, userID, date).Scan(&mealIDs); err != nil {
+		return nil, err
+	}
+
+	trees, err := getMealTrees(s, userID, mealIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	meals := []Meal{}
+	for _, tree := range trees {
+		meals = append(meals, copyMeal(tree))
+	}
+	return meals, nil
+}
+
+func insertScheduleFoods(s *Server, tx pgx.Tx, userID uint, schedule []ScheduledMeal) error {
+	sql := `
+		insert into ScheduledMealFoods
+		(UserID, Slot, Position, FoodID, Servings, ServingSize, ServingUnit)
+		values ($1, $2, $3, $4, $5, $6, $7);`
+	for _, slot := range schedule {
+		for position, food := range slot.Foods {
+			_, err := tx.Exec(s.ctx, sql, userID, slot.Name, position,
+				food.FoodID, food.Servings, food.ServingSize, food.ServingUnit)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// api endpoints
+func (s *Server) GetSchedule(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	schedule, err := getSchedule(s, user)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't get scheduled meals"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"schedule": schedule})
+}
+
+type ScheduleRequest struct {
+	Schedule []ScheduledMeal `json:"schedule"`
+}
+
+// replaces the whole schedule, so meals can be added, renamed,
+// reordered and removed at once. days already logged don't change
+func (s *Server) SetSchedule(c *gin.Context) {
+	var req ScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := c.MustGet("user").(*User)
+
+	if err := validateSchedule(s, req.Schedule, user.ID); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't set scheduled meals"})
+		return
+	}
+	defer tx.Rollback(s.ctx)
+
+	names := []string{}
+	for _, slot := range req.Schedule {
+		names = append(names, slot.Name)
+	}
+
+	sql := "update Users set ScheduledMeals = $1, LastModified = $2 where ID = $3;"
+	_, err = tx.Exec(s.ctx, sql, names, time.Now(), user.ID)
+	if err == nil {
+		sql = "delete from ScheduledMealFoods where UserID = $1;"
+		_, err = tx.Exec(s.ctx, sql, user.ID)
+	}
+	if err == nil {
+		err = insertScheduleFoods(s, tx, user.ID, req.Schedule)
+	}
+	if err == nil {
+		err = tx.Commit(s.ctx)
+	}
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't set scheduled meals"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"schedule": req.Schedule})
+}
+
+// removes ?name= from the schedule, along with its default foods
+func (s *Server) DeleteScheduledMeal(c *gin.Context) {
+	name, exists := c.GetQuery("name")
+	name = strings.TrimSpace(name) // like the names validateSchedule stores
+	if !exists || name == "" {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	user := c.MustGet("user").(*User)
+
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't delete scheduled meal"})
+		return
+	}
+	defer tx.Rollback(s.ctx)
+
+	sql := `
+		update Users set ScheduledMeals = array_remove(ScheduledMeals, $1),
+		LastModified = $2 where ID = $3;`
+	_, err = tx.Exec(s.ctx, sql, name, time.Now(), user.ID)
+	if err == nil {
+		sql = "delete from ScheduledMealFoods where UserID = $1 and Slot = $2;"
+		_, err = tx.Exec(s.ctx, sql, user.ID, name)
+	}
+	if err == nil {
+		err = tx.Commit(s.ctx)
+	}
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't delete scheduled meal"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
@@ -11,7 +12,9 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -42,11 +45,19 @@ func fetchRows[T any](s *Server, sql string, scanRow RowScanner[T], args ...any)
 	return values, nil
 }
 
+// whether the error comes from breaking a unique constraint
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
 const (
 	StatusOK                  = 200
 	StatusNoContent           = 204
 	StatusBadRequest          = 400
 	StatusUnauthorized        = 401
+	StatusForbidden           = 403
+	StatusTooManyRequests     = 429
 	StatusInternalServerError = 500
 )
 
@@ -72,15 +83,30 @@ func CORSMiddleware() gin.HandlerFunc {
 
 // verify the json web token in the authorization header
 // pass in the user to all subsequent routes if the user the jwt is refering to exists
+// and the session the jwt was issued for hasn't been revoked.
+// api tokens are accepted too, passing in their scopes as well
 func AuthMiddleware(s *Server) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		parts := strings.Split(c.GetHeader("Authorization"), " ")
-		if len(parts) != 2 && parts[0] != "Bearer" {
+		if len(parts) != 2 || parts[0] != "Bearer" {
 			c.AbortWithStatusJSON(StatusUnauthorized, gin.H{"error": "Invalid auth header"})
 			return
 		}
 
-		token, err := verifyToken(parts[1], os.Getenv("JWT_SECRET"))
+		if strings.HasPrefix(parts[1], apiTokenPrefix) {
+			user, scopes, err := authenticateAPIToken(s, parts[1])
+			if user == nil || err != nil {
+				c.AbortWithStatusJSON(StatusUnauthorized, gin.H{"error": "Invalid api token"})
+				return
+			}
+
+			c.Set("user", user)
+			c.Set("scopes", scopes)
+			c.Next()
+			return
+		}
+
+		token, err := verifyToken(parts[1], s.keys)
 		if err != nil || !token.Valid {
 			c.AbortWithStatusJSON(StatusUnauthorized, gin.H{"error": "Invalid jwt"})
 			return
@@ -98,6 +124,20 @@ func AuthMiddleware(s *Server) gin.HandlerFunc {
 			return
 		}
 
+		claims, _ := token.Claims.(jwt.MapClaims)
+		sid, _ := claims["sid"].(string)
+		sessionID, err := strconv.ParseUint(sid, 10, strconv.IntSize)
+		if err != nil {
+			c.AbortWithStatusJSON(StatusUnauthorized, gin.H{"error": "Invalid jwt"})
+			return
+		}
+
+		active, err := sessionActive(s, uint(id), uint(sessionID))
+		if err != nil || !active {
+			c.AbortWithStatusJSON(StatusUnauthorized, gin.H{"error": "Session revoked"})
+			return
+		}
+
 		user, err := getUser(s, "ID", id)
 		if user == nil || err != nil {
 			c.AbortWithStatusJSON(StatusUnauthorized, gin.H{"error": "Invalid user id"})
@@ -105,13 +145,27 @@ func AuthMiddleware(s *Server) gin.HandlerFunc {
 		}
 
 		c.Set("user", user)
+		c.Set("sessionID", uint(sessionID))
 		c.Next()
 	}
 }
 
 type Server struct {
-	db  *pgxpool.Pool
-	ctx context.Context
+	db     *pgxpool.Pool
+	ctx    context.Context
+	config Config
+	mailer Mailer
+	keys   *KeyRing
+	oidc   map[string]*OIDCProvider
+	foods  FoodProvider // nil when foods are only searched locally
+
+	usualFoods *UsualFoodsCache
+
+	ipLimiter      RateLimiter
+	accountLimiter RateLimiter
+
+	// hash to compare against when there's no real one to check
+	dummyHash string
 }
 
 func NewServer() (Server, error) {
@@ -138,7 +192,31 @@ func NewServer() (Server, error) {
 		return Server{}, err
 	}
 
-	return Server{db: pool, ctx: ctx}, nil
+	config, err := loadConfig()
+	if err != nil {
+		return Server{}, err
+	}
+	dummyHash, err := hashPassword("not a real password", config.Argon2)
+	if err != nil {
+		return Server{}, err
+	}
+
+	keys, err := loadKeyRing(config)
+	if err != nil {
+		return Server{}, err
+	}
+
+	server := Server{
+		db: pool, ctx: ctx, config: config, keys: keys,
+		mailer: newMailer(config), dummyHash: dummyHash,
+		oidc: newOIDCProviders(config), foods: newFoodProvider(config),
+		usualFoods: newUsualFoodsCache(),
+	}
+	server.ipLimiter = newRateLimiter(&server, "ip",
+		config.IPRateLimit, config.IPRateBurst)
+	server.accountLimiter = newRateLimiter(&server, "account",
+		config.AccountRateLimit, config.AccountRateBurst)
+	return server, nil
 }
 
 func (s *Server) Cleanup() { s.db.Close() }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// a device the user is logged in on
+type Session struct {
+	ID        uint      `json:"id"`
+	Device    string    `json:"device"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastUsed  time.Time `json:"lastUsed"`
+	Current   bool      `json:"current"`
+}
+
+type TokenPair struct {
+	JWT          string `json:"jwt"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+var errInvalidRefreshToken = errors.New("invalid refresh token")
+
+// start a new session for the user and hand out its first pair of tokens
+func startSession(s *Server, userID uint, device string) (TokenPair, error) {
+	refreshToken, hash, err := createRandomToken()
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	sql := `
+		insert into Sessions
+		(LastModified, Revoked, UserID, Device, RefreshToken,
+		 PreviousToken, CreatedAt, ExpiresAt)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning ID;`
+
+	var sessionID uint
+	now := time.Now()
+	err = s.db.QueryRow(s.ctx, sql, now, false, userID, device, hash, "",
+		now, now.Add(refreshTokenLifetime)).Scan(&sessionID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	token, err := createToken(fmt.Sprintf("%d", userID),
+		fmt.Sprintf("%d", sessionID), s.keys)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{JWT: token, RefreshToken: refreshToken}, nil
+}
+
+// exchange a refresh token for a new pair of tokens. the refresh token
+// is rotated on every use, so presenting an already used token means it
+// was stolen, in which case the whole session gets revoked
+func refreshSession(s *Server, refreshToken string) (TokenPair, error) {
+	hash := hashToken(refreshToken)
+
+	var sessionID, userID uint
+	sql := `
+		select ID, UserID from Sessions
+		where RefreshToken = $1 and Revoked = false and ExpiresAt > $2;`
+	err := s.db.QueryRow(s.ctx, sql, hash, time.Now()).Scan(&sessionID, &userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		sql := `
+			update Sessions set Revoked = true, LastModified = $1
+			where PreviousToken = $2;`
+		if _, err := s.db.Exec(s.ctx, sql, time.Now(), hash); err != nil {
+			return TokenPair{}, err
+		}
+		return TokenPair{}, errInvalidRefreshToken
+	} else if err != nil {
+		return TokenPair{}, err
+	}
+
+	newToken, newHash, err := createRandomToken()
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	now := time.Now()
+	sql = `
+		update Sessions set RefreshToken = $1, PreviousToken = $2,
+		LastModified = $3, ExpiresAt = $4
+		where ID = $5 and RefreshToken = $2;`
+	tag, err := s.db.Exec(s.ctx, sql, newHash, hash, now,
+		now.Add(refreshTokenLifetime), sessionID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if tag.RowsAffected() == 0 { // lost a race with another refresh
+		return TokenPair{}, errInvalidRefreshToken
+	}
+
+	token, err := createToken(fmt.Sprintf("%d", userID),
+		fmt.Sprintf("%d", sessionID), s.keys)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{JWT: token, RefreshToken: newToken}, nil
+}
+
+func sessionActive(s *Server, userID, sessionID uint) (bool, error) {
+	sql := `
+		select count(*) from Sessions
+		where ID = $1 and UserID = $2 and Revoked = false and ExpiresAt > $3;`
+	var count int
+	err := s.db.QueryRow(s.ctx, sql, sessionID, userID, time.Now()).Scan(&count)
+	return count > 0, err
+}
+
+func revokeSession(s *Server, userID, sessionID uint) error {
+	sql := `
+		update Sessions set Revoked = true, LastModified = $1
+		where ID = $2 and UserID = $3;`
+	_, err := s.db.Exec(s.ctx, sql, time.Now(), sessionID, userID)
+	return err
+}
+
+// revoke all of the user's sessions except for one (pass 0 to revoke all of them)
+func revokeSessions(s *Server, userID, except uint) error {
+	sql := `
+		update Sessions set Revoked = true, LastModified = $1
+		where UserID = $2 and ID != $3 and Revoked = false;`
+	_, err := s.db.Exec(s.ctx, sql, time.Now(), userID, except)
+	return err
+}
+
+func getSessions(s *Server, userID, currentID uint) ([]Session, error) {
+	scanSession := func(rows pgx.Rows) (Session, error) {
+		var session Session
+		err := rows.Scan(&session.ID, &session.Device,
+			&session.CreatedAt, &session.LastUsed)
+		session.Current = session.ID == currentID
+		return session, err
+	}
+
+	sql := `
+		select ID, Device, CreatedAt, LastModified from Sessions
+		where UserID = $1 and Revoked = false and ExpiresAt > $2
+		order by LastModified desc;`
+	return fetchRows(s, sql, scanSession, userID, time.Now())
+}
+
+// api endpoints
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+func (s *Server) RefreshToken(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokens, err := refreshSession(s, req.RefreshToken)
+	if errors.Is(err, errInvalidRefreshToken) {
+		c.JSON(StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	} else if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't refresh session"})
+		return
+	}
+
+	c.JSON(StatusOK, tokens)
+}
+
+func (s *Server) Logout(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+	sessionID := c.MustGet("sessionID").(uint)
+
+	if err := revokeSession(s, user.ID, sessionID); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't end session"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
+
+func (s *Server) GetSessions(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+	sessionID := c.MustGet("sessionID").(uint)
+
+	sessions, err := getSessions(s, user.ID, sessionID)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't get sessions"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"sessions": sessions})
+}
+
+func (s *Server) RevokeSession(c *gin.Context) {
+	idStr, exists := c.GetQuery("id")
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if !exists || err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	user := c.MustGet("user").(*User)
+	if err := revokeSession(s, user.ID, uint(id)); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't revoke session"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// how far back logged foods count towards suggestions, and how
+// long it takes for a food's use to count half as much
+const (
+	suggestionWindow   = 180 * 24 * time.Hour
+	suggestionHalfLife = 14 * 24 * time.Hour
+)
+
+type FoodSuggestion struct {
+	Food     Food    `json:"food"`
+	Uses     int     `json:"uses"`
+	LastUsed string  `json:"lastUsed"`
+	Score    float64 `json:"score"`
+
+	foodID uint
+}
+
+// what the suggestions are for, both are optional. foods logged in a slot
+// with the same name, or around the same time of day, count up to double
+type SuggestionContext struct {
+	Slot string
+	Time time.Time
+}
+
+// a food logged in one of the user's meals
+type foodUse struct {
+	FoodID   uint
+	Date     time.Time
+	Slot     string // the name of the top level meal it was logged in
+	LoggedAt time.Time
+}
+
+func getFoodUses(s *Server, userID uint) ([]foodUse, error) {
+	scanUse := func(rows pgx.Rows) (foodUse, error) {
+		var u foodUse
+		var date string
+		err := rows.Scan(&u.FoodID, &date, &u.Slot, &u.LoggedAt)
+		if parsed, dateErr := parseLogDate(date); dateErr == nil {
+			u.Date = parsed
+		} else {
+			u.Date = u.LoggedAt
+		}
+		return u, err
+	}
+
+	sql := `
+		with recursive tree as (
+			select Meals.ID, Meals.FoodID, DailyFoodLogs.Date,
+			       Meals.Name as Slot, Meals.LastModified
+			from DailyFoodLogs
+			join Meals on Meals.ID = any(DailyFoodLogs.MealIDs)
+			where DailyFoodLogs.UserID = $1 and DailyFoodLogs.Deleted = false
+			and DailyFoodLogs.LastModified >= $2 and Meals.UserID = $1 and Meals.Deleted = false
+			union all
+			select Meals.ID, Meals.FoodID, tree.Date, tree.Slot, Meals.LastModified
+			from Meals join tree on Meals.ParentID = tree.ID
+			where Meals.UserID = $1 and Meals.Deleted = false
+		)
+		select FoodID, Date, Slot, LastModified from tree
+		where FoodID != 0 and LastModified >= $2;`
+	return fetchRows(s, sql, scanUse, userID, time.Now().Add(-suggestionWindow))
+}
+
+// old version id -> the latest version of the food, so that foods
+// that have been edited since they were logged are still suggested
+func getLatestVersions(s *Server, foodIDs []uint) (map[uint]uint, error) {
+	type version struct{ Original, Latest uint }
+	scanVersion := func(rows pgx.Rows) (version, error) {
+		var v version
+		err := rows.Scan(&v.Original, &v.Latest)
+		return v, err
+	}
+
+	sql := `
+		with recursive versions as (
+			select ID as Original, ID, Latest, Deleted from Foods where ID = any($1)
+			union all
+			select versions.Original, Foods.ID, Foods.Latest, Foods.Deleted
+			from Foods join versions on Foods.PreviousID = versions.ID
+		)
+		select Original, ID from versions where Latest = true and Deleted = false;`
+	rows, err := fetchRows(s, sql, scanVersion, foodIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := map[uint]uint{}
+	for _, v := range rows {
+		latest[v.Original] = v.Latest
+	}
+	return latest, nil
+}
+
+// hours between the times of day, going around midnight if that's shorter
+func hourDistance(a, b time.Time) float64 {
+	hours := func(t time.Time) float64 { return float64(t.Hour()) + float64(t.Minute())/60 }
+	d := math.Abs(hours(a) - hours(b))
+	return math.Min(d, 24-d)
+}
+
+// every use of a food adds to its score, by how recent it is and how well
+// it fits the context. foods eaten often and lately end up on top
+func rankFoods(uses []foodUse, latest map[uint]uint,
+	context SuggestionContext, now time.Time) []FoodSuggestion {
+	ranked := map[uint]*FoodSuggestion{}
+	lastUsed := map[uint]time.Time{}
+	for _, use := range uses {
+		id, exists := latest[use.FoodID]
+		if !exists {
+			continue // deleted since
+		}
+
+		age := max(now.Sub(use.Date), 0)
+		score := math.Pow(0.5, float64(age)/float64(suggestionHalfLife))
+		if context.Slot != "" && strings.EqualFold(context.Slot, use.Slot) {
+			score *= 2
+		}
+		if !context.Time.IsZero() {
+			d := hourDistance(context.Time, use.LoggedAt.In(context.Time.Location()))
+			score *= 1 + max(0, 1-d/3)
+		}
+
+		if ranked[id] == nil {
+			ranked[id] = &FoodSuggestion{Food: Food{ID: fmt.Sprint(id)}, foodID: id}
+		}
+		ranked[id].Uses++
+		ranked[id].Score += score
+		if use.Date.After(lastUsed[id]) {
+			lastUsed[id] = use.Date
+			ranked[id].LastUsed = use.Date.Format(logDateLayout)
+		}
+	}
+
+	suggestions := []FoodSuggestion{}
+	for _, suggestion := range ranked {
+		suggestions = append(suggestions, *suggestion)
+	}
+	slices.SortFunc(suggestions, func(a, b FoodSuggestion) int {
+		if a.Score != b.Score {
+			if a.Score > b.Score {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.foodID, b.foodID)
+	})
+	return suggestions
+}
+
+// the user's usual foods, best first
+func getSuggestions(s *Server, userID uint, context SuggestionContext, limit int) ([]FoodSuggestion, error) {
+	uses, err := getFoodUses(s, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	foodIDs := []uint{}
+	for _, use := range uses {
+		foodIDs = append(foodIDs, use.FoodID)
+	}
+	latest, err := getLatestVersions(s, foodIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	suggestions := rankFoods(uses, latest, context, time.Now())
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+
+	ids := []uint{}
+	for _, suggestion := range suggestions {
+		ids = append(ids, suggestion.foodID)
+	}
+	sql := fmt.Sprintf("select %s from Foods where Foods.ID = any($1) and %s;",
+		foodColumns, visibleFoods(2))
+	foods, err := fetchRows(s, sql, scanFood, ids, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// foods that have become private to someone else are left out
+	visible := []FoodSuggestion{}
+	for _, suggestion := range suggestions {
+		i := slices.IndexFunc(foods, func(f Food) bool { return f.ID == suggestion.Food.ID })
+		if i != -1 {
+			suggestion.Food = foods[i]
+			visible = append(visible, suggestion)
+		}
+	}
+	return visible, nil
+}
+
+// how long a user's usual foods are reused for, so that paging through
+// a search doesn't rank everything they've logged again for every page
+const usualFoodsLifetime = 5 * time.Minute
+
+type usualFoodsEntry struct {
+	ids     []uint
+	expires time.Time
+}
+
+type UsualFoodsCache struct {
+	mu      sync.Mutex
+	entries map[uint]usualFoodsEntry
+}
+
+func newUsualFoodsCache() *UsualFoodsCache {
+	return &UsualFoodsCache{entries: map[uint]usualFoodsEntry{}}
+}
+
+func (c *UsualFoodsCache) get(userID uint, now time.Time) ([]uint, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, exists := c.entries[userID]
+	if !exists || now.After(entry.expires) {
+		return nil, false
+	}
+	return entry.ids, true
+}
+
+func (c *UsualFoodsCache) set(userID uint, ids []uint, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) > 10000 {
+		for id, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, id)
+			}
+		}
+	}
+	c.entries[userID] = usualFoodsEntry{ids: ids, expires: now.Add(usualFoodsLifetime)}
+}
+
+// ids of the user's usual foods, best first, to rank them first in searches
+func usualFoods(s *Server, userID uint) ([]uint, error) {
+	now := time.Now()
+	if ids, cached := s.usualFoods.get(userID, now); cached {
+		return ids, nil
+	}
+
+	suggestions, err := getSuggestions(s, userID, SuggestionContext{}, 100)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []uint{}
+	for _, suggestion := range suggestions {
+		ids = append(ids, suggestion.foodID)
+	}
+	s.usualFoods.set(userID, ids, now)
+	return ids, nil
+}
+
+// api endpoints
+
+// the user's usual foods. ?slot= is the name of the meal they're logging
+// into and ?time= the client's local time, like 2006-01-02T08:30:00-05:00
+func (s *Server) SuggestFoods(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	context := SuggestionContext{Slot: strings.TrimSpace(c.Query("slot"))}
+	if value, exists := c.GetQuery("time"); exists {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(StatusBadRequest, gin.H{"error": "Invalid time"})
+			return
+		}
+		context.Time = t
+	}
+
+	limit := 20
+	if value, exists := c.GetQuery("limit"); exists {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > 100 {
+			c.JSON(StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+	}
+
+	suggestions, err := getSuggestions(s, user.ID, context, limit)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't suggest foods"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"suggestions": suggestions})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHourDistance(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2025, 1, 1, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		a, b  time.Time
+		hours float64
+	}{
+		{at(8, 0), at(8, 0), 0},
+		{at(8, 30), at(10, 0), 1.5},
+		{at(10, 0), at(8, 30), 1.5},
+		{at(23, 0), at(1, 0), 2},
+		{at(0, 15), at(23, 45), 0.5},
+		{at(12, 0), at(0, 0), 12},
+	}
+
+	for _, test := range tests {
+		if d := hourDistance(test.a, test.b); !closeTo(d, test.hours) {
+			t.Errorf("%s to %s: got %v, want %v",
+				test.a.Format("15:04"), test.b.Format("15:04"), d, test.hours)
+		}
+	}
+}
+
+func TestRankFoods(t *testing.T) {
+	now := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	use := func(foodID uint, age time.Duration, slot string, hour int) foodUse {
+		date := now.Add(-age)
+		loggedAt := time.Date(date.Year(), date.Month(), date.Day(), hour, 0, 0, 0, time.UTC)
+		return foodUse{FoodID: foodID, Date: date, Slot: slot, LoggedAt: loggedAt}
+	}
+	latest := map[uint]uint{1: 1, 2: 2, 3: 3, 4: 5, 5: 5}
+
+	tests := []struct {
+		name    string
+		uses    []foodUse
+		context SuggestionContext
+		ids     []uint
+		scores  []float64
+	}{
+		{
+			name:   "recent first",
+			uses:   []foodUse{use(1, 14*day, "", 12), use(2, 0, "", 12)},
+			ids:    []uint{2, 1},
+			scores: []float64{1, 0.5},
+		},
+		{
+			name:   "uses add up",
+			uses:   []foodUse{use(1, 0, "", 12), use(2, 0, "", 12), use(2, 14*day, "", 12)},
+			ids:    []uint{2, 1},
+			scores: []float64{1.5, 1},
+		},
+		{
+			name:   "ties by id",
+			uses:   []foodUse{use(3, 0, "", 12), use(1, 0, "", 12)},
+			ids:    []uint{1, 3},
+			scores: []float64{1, 1},
+		},
+		{
+			name:   "logged in the future",
+			uses:   []foodUse{use(1, -day, "", 12)},
+			ids:    []uint{1},
+			scores: []float64{1},
+		},
+		{
+			name:   "deleted foods",
+			uses:   []foodUse{use(1, 0, "", 12), use(9, 0, "", 12)},
+			ids:    []uint{1},
+			scores: []float64{1},
+		},
+		{
+			name:   "old versions count for the latest",
+			uses:   []foodUse{use(4, 0, "", 12), use(5, 0, "", 12), use(1, 0, "", 12)},
+			ids:    []uint{5, 1},
+			scores: []float64{2, 1},
+		},
+		{
+			name:    "same slot",
+			uses:    []foodUse{use(1, 0, "Breakfast", 12), use(2, 0, "Lunch", 12)},
+			context: SuggestionContext{Slot: "breakfast"},
+			ids:     []uint{1, 2},
+			scores:  []float64{2, 1},
+		},
+		{
+			name:    "time of day",
+			uses:    []foodUse{use(1, 0, "", 8), use(2, 0, "", 13), use(3, 0, "", 20)},
+			context: SuggestionContext{Time: time.Date(2025, 3, 15, 9, 30, 0, 0, time.UTC)},
+			ids:     []uint{1, 2, 3},
+			scores:  []float64{1.5, 1, 1},
+		},
+	}
+
+	for _, test := range tests {
+		suggestions := rankFoods(test.uses, latest, test.context, now)
+		if len(suggestions) != len(test.ids) {
+			t.Errorf("%s: got %d suggestions, want %d", test.name, len(suggestions), len(test.ids))
+			continue
+		}
+		for i, suggestion := range suggestions {
+			if suggestion.foodID != test.ids[i] || !closeTo(suggestion.Score, test.scores[i]) {
+				t.Errorf("%s: got food %d scored %v at %d, want %d scored %v", test.name,
+					suggestion.foodID, suggestion.Score, i, test.ids[i], test.scores[i])
+			}
+		}
+	}
+}
+
+func TestRankFoodsLastUsed(t *testing.T) {
+	now := time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)
+	uses := []foodUse{
+		{FoodID: 1, Date: now.AddDate(0, 0, -3), LoggedAt: now},
+		{FoodID: 1, Date: now.AddDate(0, 0, -1), LoggedAt: now},
+		{FoodID: 1, Date: now.AddDate(0, 0, -7), LoggedAt: now},
+	}
+
+	suggestions := rankFoods(uses, map[uint]uint{1: 1}, SuggestionContext{}, now)
+	if len(suggestions) != 1 {
+		t.Fatalf("got %d suggestions", len(suggestions))
+	}
+	if suggestions[0].Uses != 3 || suggestions[0].LastUsed != "March 14, 2025" {
+		t.Errorf("got %d uses, last on %s", suggestions[0].Uses, suggestions[0].LastUsed)
+	}
+	if suggestions[0].Food.ID != "1" {
+		t.Errorf("got food id %q", suggestions[0].Food.ID)
+	}
+}
@@ -58,17 +58,7 @@ create table if not exists Foods (
 
     Name text not null,
     ServingSizes float[] not null,
-    ServingSizeUnits text[] not null,
-
-    Calories float not null,
-    Protein float not null,
-    Carbohydrates float not null,
-    Fat float not null,
-    Cholesterol float not null,
-    Calcium float not null,
-    Sodium float not null,
-    Magnesium float not null,
-    Potassium float not null
+    ServingSizeUnits text[] not null
 );
 
 create table if not exists Meals (
@@ -100,3 +90,310 @@ create table if not exists DailyFoodLogs (
     CONSTRAINT unique_row UNIQUE (UserID, Date),
     CONSTRAINT fk_food_log_uesr FOREIGN KEY(UserID) REFERENCES Users(ID)
 );
+
+create table if not exists Sessions (
+    ID serial primary key,
+    LastModified timestamp not null,
+    Revoked boolean not null,
+
+    UserID int not null,
+    Device text not null,
+    RefreshToken text not null,
+    PreviousToken text not null,
+    CreatedAt timestamp not null,
+    ExpiresAt timestamp not null,
+
+    CONSTRAINT fk_sessions_user FOREIGN KEY(UserID) REFERENCES Users(ID)
+);
+
+alter table Users add column if not exists EmailVerified boolean not null default false;
+
+create table if not exists EmailTokens (
+    ID serial primary key,
+    LastModified timestamp not null,
+    Used boolean not null,
+
+    UserID int not null,
+    Purpose text not null,
+    Token text not null,
+    ExpiresAt timestamp not null,
+
+    CONSTRAINT fk_email_tokens_user FOREIGN KEY(UserID) REFERENCES Users(ID)
+);
+
+create table if not exists RateLimits (
+    Key text primary key,
+    LastModified timestamp not null,
+    Tokens float not null
+);
+
+create table if not exists LoginFailures (
+    Email text primary key,
+    LastModified timestamp not null,
+    Failures int not null,
+    LockedUntil timestamp not null
+);
+
+alter table Users add column if not exists TOTPEnabled boolean not null default false;
+alter table Users add column if not exists TOTPSecret text not null default '';
+alter table Users add column if not exists TOTPLastStep bigint not null default 0;
+
+create table if not exists RecoveryCodes (
+    ID serial primary key,
+    LastModified timestamp not null,
+    Used boolean not null,
+
+    UserID int not null,
+    Code text not null,
+
+    CONSTRAINT fk_recovery_codes_user FOREIGN KEY(UserID) REFERENCES Users(ID)
+);
+
+create table if not exists Identities (
+    ID serial primary key,
+    LastModified timestamp not null,
+
+    UserID int not null,
+    Provider text not null,
+    Subject text not null,
+    Email text not null,
+
+    CONSTRAINT unique_identity UNIQUE (Provider, Subject),
+    CONSTRAINT fk_identities_user FOREIGN KEY(UserID) REFERENCES Users(ID)
+);
+
+create table if not exists OIDCStates (
+    State text primary key,
+    LastModified timestamp not null,
+
+    Provider text not null,
+    UserID int not null,
+    Nonce text not null,
+    Verifier text not null,
+    ExpiresAt timestamp not null
+);
+
+create table if not exists DeletionRequests (
+    ID serial primary key,
+    LastModified timestamp not null,
+
+    UserID int not null, -- no foreign key, the request outlives the user
+    Email text not null,
+    Receipt text not null,
+    Status text not null,
+    RequestedAt timestamp not null,
+    PurgeAfter timestamp not null,
+    CompletedAt timestamp
+);
+
+create unique index if not exists unique_user_email on Users (lower(Email)) where Deleted = false;
+
+create table if not exists APITokens (
+    ID serial primary key,
+    LastModified timestamp not null,
+    Revoked boolean not null,
+
+    UserID int not null,
+    Name text not null,
+    Token text not null,
+    Scopes text[] not null,
+    CreatedAt timestamp not null,
+    LastUsed timestamp,
+    ExpiresAt timestamp,
+
+    CONSTRAINT fk_api_tokens_user FOREIGN KEY(UserID) REFERENCES Users(ID)
+);
+
+create extension if not exists pg_trgm;
+create index if not exists foods_name_search on Foods using gin (to_tsvector('english', Name));
+create index if not exists foods_name_trigram on Foods using gin (Name gin_trgm_ops);
+
+-- foods cached from a FoodProvider
+alter table Foods add column if not exists Source text not null default '';
+alter table Foods add column if not exists SourceID text not null default '';
+create unique index if not exists foods_source on Foods (Source, SourceID) where Source != '';
+
+alter table Foods add column if not exists Barcode text not null default '';
+create index if not exists foods_barcode on Foods (Barcode) where Barcode != '';
+
+-- foods created by users belong to them, foods from providers to nobody.
+-- edits create a new version that points back at the previous one
+alter table Foods add column if not exists UserID int references Users(ID);
+alter table Foods add column if not exists Shared boolean not null default true;
+alter table Foods add column if not exists Version int not null default 1;
+alter table Foods add column if not exists PreviousID int;
+alter table Foods add column if not exists Latest boolean not null default true;
+alter table Foods add column if not exists Deleted boolean not null default false;
+create index if not exists foods_user on Foods (UserID) where UserID is not null;
+
+-- progress of `aro import-foods`, so interrupted imports can be resumed
+create table if not exists FoodImports (
+    ID serial primary key,
+    LastModified timestamp not null,
+
+    Format text not null,
+    File text not null,
+    Imported int not null, -- records of the file handled so far
+    Completed boolean not null,
+
+    unique (Format, File)
+);
+
+-- every nutrient foods can have. amounts are per 1 g of food, in Unit
+create table if not exists Nutrients (
+    Code text primary key,
+    Name text not null,
+    Unit text not null,
+    Position int not null -- the order they're listed in
+);
+
+insert into Nutrients (Code, Name, Unit, Position) values
+    ('calories', 'Calories', 'kcal', 1),
+    ('fat', 'Fat', 'g', 2),
+    ('saturatedFat', 'Saturated fat', 'g', 3),
+    ('transFat', 'Trans fat', 'g', 4),
+    ('monounsaturatedFat', 'Monounsaturated fat', 'g', 5),
+    ('polyunsaturatedFat', 'Polyunsaturated fat', 'g', 6),
+    ('cholesterol', 'Cholesterol', 'mg', 7),
+    ('sodium', 'Sodium', 'mg', 8),
+    ('carbohydrates', 'Carbohydrates', 'g', 9),
+    ('fiber', 'Fiber', 'g', 10),
+    ('sugars', 'Sugars', 'g', 11),
+    ('addedSugars', 'Added sugars', 'g', 12),
+    ('protein', 'Protein', 'g', 13),
+    ('alcohol', 'Alcohol', 'g', 14),
+    ('caffeine', 'Caffeine', 'mg', 15),
+    ('vitaminA', 'Vitamin A', 'µg', 16),
+    ('vitaminC', 'Vitamin C', 'mg', 17),
+    ('vitaminD', 'Vitamin D', 'µg', 18),
+    ('vitaminE', 'Vitamin E', 'mg', 19),
+    ('vitaminK', 'Vitamin K', 'µg', 20),
+    ('thiamin', 'Thiamin', 'mg', 21),
+    ('riboflavin', 'Riboflavin', 'mg', 22),
+    ('niacin', 'Niacin', 'mg', 23),
+    ('vitaminB6', 'Vitamin B6', 'mg', 24),
+    ('folate', 'Folate', 'µg', 25),
+    ('vitaminB12', 'Vitamin B12', 'µg', 26),
+    ('calcium', 'Calcium', 'mg', 27),
+    ('iron', 'Iron', 'mg', 28),
+    ('magnesium', 'Magnesium', 'mg', 29),
+    ('phosphorus', 'Phosphorus', 'mg', 30),
+    ('potassium', 'Potassium', 'mg', 31),
+    ('zinc', 'Zinc', 'mg', 32)
+on conflict (Code) do update set
+    Name = excluded.Name, Unit = excluded.Unit, Position = excluded.Position;
+
+create table if not exists FoodNutrients (
+    FoodID int not null,
+    Code text not null,
+    Amount float not null,
+
+    primary key (FoodID, Code),
+    CONSTRAINT fk_food_nutrients_food FOREIGN KEY(FoodID) REFERENCES Foods(ID),
+    CONSTRAINT fk_food_nutrients_nutrient FOREIGN KEY(Code) REFERENCES Nutrients(Code)
+);
+create index if not exists food_nutrients_code on FoodNutrients (Code, Amount);
+
+-- foods used to have a column per nutrient, move them over to FoodNutrients
+do $$
+begin
+    if exists (select 1 from information_schema.columns
+               where table_name = 'foods' and column_name = 'calories') then
+        insert into FoodNutrients (FoodID, Code, Amount)
+        select Foods.ID, n.Code, n.Amount from Foods, lateral (values
+            ('calories', Calories), ('protein', Protein),
+            ('carbohydrates', Carbohydrates), ('fat', Fat),
+            ('cholesterol', Cholesterol), ('calcium', Calcium), ('sodium', Sodium),
+            ('magnesium', Magnesium), ('potassium', Potassium)) n(Code, Amount)
+        on conflict do nothing;
+
+        alter table Foods
+            drop column Calories, drop column Protein, drop column Carbohydrates,
+            drop column Fat, drop column Cholesterol, drop column Calcium,
+            drop column Sodium, drop column Magnesium, drop column Potassium;
+    end if;
+end $$;
+
+create table if not exists NutritionGoals (
+    ID serial primary key,
+    LastModified timestamp not null,
+
+    UserID int not null,
+    Code text not null,
+    Weekday int not null, -- 0 is sunday, -1 every day
+    Min float,
+    Max float,
+    EffectiveFrom date not null,
+
+    unique (UserID, Code, Weekday, EffectiveFrom),
+    CONSTRAINT fk_goals_user FOREIGN KEY(UserID) REFERENCES Users(ID),
+    CONSTRAINT fk_goals_nutrient FOREIGN KEY(Code) REFERENCES Nutrients(Code)
+);
+
+-- for measuring foods in volumes and food specific units like "slice"
+alter table Foods add column if not exists Density float not null default 0; -- g per ml
+
+create table if not exists FoodPortions (
+    FoodID int not null,
+    Unit text not null,
+    Grams float not null,
+
+    primary key (FoodID, Unit),
+    CONSTRAINT fk_food_portions_food FOREIGN KEY(FoodID) REFERENCES Foods(ID)
+);
+
+-- servings can be fractional, like 1.5 cups. only while they're still
+-- integers, since changing the type locks the whole table
+do $$
+begin
+    if exists (select 1 from information_schema.columns
+               where table_name = 'meals' and column_name = 'servings'
+               and data_type = 'integer') then
+        alter table Meals alter column Servings type float;
+    end if;
+    if exists (select 1 from information_schema.columns
+               where table_name = 'meals' and column_name = 'servingsize'
+               and data_type = 'integer') then
+        alter table Meals alter column ServingSize type float;
+    end if;
+end $$;
+
+create table if not exists Recipes (
+    ID serial primary key,
+    LastModified timestamp not null,
+    Deleted boolean not null,
+
+    UserID int not null,
+    Name text not null,
+    Yield float not null, -- servings the recipe makes
+
+    CONSTRAINT fk_recipes_user FOREIGN KEY(UserID) REFERENCES Users(ID)
+);
+
+create table if not exists RecipeIngredients (
+    ID serial primary key,
+    RecipeID int not null,
+    FoodID int not null,
+    Amount float not null,
+    Unit text not null,
+    Position int not null,
+
+    CONSTRAINT fk_ingredients_recipe FOREIGN KEY(RecipeID) REFERENCES Recipes(ID),
+    CONSTRAINT fk_ingredients_food FOREIGN KEY(FoodID) REFERENCES Foods(ID)
+);
+
+-- the foods logged into a scheduled meal when a day is created
+create table if not exists ScheduledMealFoods (
+    ID serial primary key,
+    UserID int not null,
+    Slot text not null, -- the meal's name in Users.ScheduledMeals
+    Position int not null,
+
+    FoodID int not null,
+    Servings float not null,
+    ServingSize float not null,
+    ServingUnit text not null,
+
+    CONSTRAINT fk_schedule_user FOREIGN KEY(UserID) REFERENCES Users(ID),
+    CONSTRAINT fk_schedule_food FOREIGN KEY(FoodID) REFERENCES Foods(ID)
+);
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// time based one time passwords (RFC 6238), with the
+// defaults authenticator apps expect: SHA1, 6 digits, 30 seconds
+const (
+	totpDigits = 6
+	totpPeriod = 30
+
+	totpChallengeLifetime = 5 * time.Minute
+	recoveryCodeCount     = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// 10^totpDigits, codes are the value's last totpDigits digits
+var totpModulus = uint32(math.Pow10(totpDigits))
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func totpURI(secret string, email string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", "aro")
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(totpPeriod))
+	label := url.PathEscape("aro:" + email)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+// the HOTP value (RFC 4226) for one time step
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulus)
+}
+
+// check the code against the current time step and its neighbours, to allow for
+// clock drift. codes from steps at or before lastStep were already used, so
+// they're rejected. returns the step the code matched
+func verifyTOTP(secret string, code string, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	now := time.Now().Unix() / totpPeriod
+	for step := now - 1; step <= now+1; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected := totpCode(key, step)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// recovery codes look like "abcde-fghij"
+func generateRecoveryCode() (string, error) {
+	bytes := make([]byte, 7)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(totpEncoding.EncodeToString(bytes))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
+
+// replace the user's recovery codes with a new set
+func createRecoveryCodes(s *Server, userID uint) ([]string, error) {
+	codes := []string{}
+	hashes := []string{}
+	for range recoveryCodeCount {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		hash, err := hashPassword(normalizeRecoveryCode(code), s.config.Argon2)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, hash)
+	}
+
+	tx, err := s.db.Begin(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(s.ctx)
+
+	sql := "delete from RecoveryCodes where UserID = $1;"
+	if _, err := tx.Exec(s.ctx, sql, userID); err != nil {
+		return nil, err
+	}
+
+	sql = `
+		insert into RecoveryCodes (LastModified, Used, UserID, Code)
+		values ($1, $2, $3, $4);`
+	for _, hash := range hashes {
+		if _, err := tx.Exec(s.ctx, sql, time.Now(), false, userID, hash); err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit(s.ctx)
+}
+
+// check the code against each of the user's unused recovery
+// codes, marking the one it matches as used
+func useRecoveryCode(s *Server, userID uint, code string) (bool, error) {
+	type recoveryCode struct {
+		ID   uint
+		Hash string
+	}
+	scanCode := func(rows pgx.Rows) (recoveryCode, error) {
+		var c recoveryCode
+		err := rows.Scan(&c.ID, &c.Hash)
+		return c, err
+	}
+
+	sql := "select ID, Code from RecoveryCodes where UserID = $1 and Used = false;"
+	codes, err := fetchRows(s, sql, scanCode, userID)
+	if err != nil {
+		return false, err
+	}
+
+	code = normalizeRecoveryCode(code)
+	for _, c := range codes {
+		matches, err := verifyPassword(code, c.Hash)
+		if err != nil {
+			return false, err
+		}
+		if !matches {
+			continue
+		}
+
+		sql := `
+			update RecoveryCodes set Used = true, LastModified = $1
+			where ID = $2 and Used = false;`
+		tag, err := s.db.Exec(s.ctx, sql, time.Now(), c.ID)
+		return tag.RowsAffected() == 1, err
+	}
+
+	return false, nil
+}
+
+// check a one time password or a recovery code. remembers the time step of
+// the last accepted one time password, so it can't be replayed
+func verifySecondFactor(s *Server, user *User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		step, ok := verifyTOTP(user.TOTPSecret, code, user.TOTPLastStep)
+		if !ok {
+			return false, nil
+		}
+
+		sql := `
+			update Users set TOTPLastStep = $1
+			where ID = $2 and TOTPLastStep < $1;`
+		tag, err := s.db.Exec(s.ctx, sql, step, user.ID)
+		return tag.RowsAffected() == 1, err
+	}
+
+	return useRecoveryCode(s, user.ID, code)
+}
+
+// the password was correct, but the jwt is only handed out after the second
+// factor is checked. this proves the first step was completed in the meantime.
+// it doesn't have a session id, so AuthMiddleware won't accept it
+func createTOTPChallenge(s *Server, userID uint) (string, error) {
+	claims := jwt.MapClaims{
+		"sub":     fmt.Sprintf("%d", userID),
+		"purpose": "totp",
+		"exp":     time.Now().Add(totpChallengeLifetime).Unix(),
+	}
+	return s.keys.Sign(claims)
+}
+
+func verifyTOTPChallenge(s *Server, challenge string) (uint, error) {
+	token, err := s.keys.Verify(challenge)
+	if err != nil || !token.Valid {
+		return 0, fmt.Errorf("invalid challenge")
+	}
+
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if purpose, _ := claims["purpose"].(string); purpose != "totp" {
+		return 0, fmt.Errorf("invalid challenge")
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(subject, 10, strconv.IntSize)
+	return uint(id), err
+}
+
+// api endpoints
+type TOTPRequest struct {
+	Challenge string `json:"challenge,omitempty"`
+	Code      string `json:"code"`
+}
+
+// start enrolling, two factor authentication only gets
+// enabled once the user confirms they can generate codes
+func (s *Server) EnrollTOTP(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+	if user.TOTPEnabled {
+		c.JSON(StatusBadRequest, gin.H{"error": "Two factor authentication already enabled"})
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't generate secret"})
+		return
+	}
+
+	sql := `
+		update Users set TOTPSecret = $1, TOTPLastStep = 0, LastModified = $2
+		where ID = $3;`
+	if _, err := s.db.Exec(s.ctx, sql, secret, time.Now(), user.ID); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't save secret"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"secret": secret, "uri": totpURI(secret, user.Email)})
+}
+
+func (s *Server) ConfirmTOTP(c *gin.Context) {
+	var req TOTPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user := c.MustGet("user").(*User)
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	step, ok := verifyTOTP(user.TOTPSecret, strings.TrimSpace(req.Code), user.TOTPLastStep)
+	if !ok {
+		c.JSON(StatusBadRequest, gin.H{"error": "Wrong code"})
+		return
+	}
+
+	codes, err := createRecoveryCodes(s, user.ID)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't create recovery codes"})
+		return
+	}
+
+	sql := `
+		update Users set TOTPEnabled = true, TOTPLastStep = $1, LastModified = $2
+		where ID = $3;`
+	if _, err := s.db.Exec(s.ctx, sql, step, time.Now(), user.ID); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't enable two factor authentication"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+func (s *Server) DisableTOTP(c *gin.Context) {
+	var req TOTPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user := c.MustGet("user").(*User)
+	if !user.TOTPEnabled {
+		c.JSON(StatusBadRequest, gin.H{"error": "Two factor authentication isn't enabled"})
+		return
+	}
+
+	ok, err := verifySecondFactor(s, user, req.Code)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't verify code"})
+		return
+	}
+	if !ok {
+		c.JSON(StatusBadRequest, gin.H{"error": "Wrong code"})
+		return
+	}
+
+	sql := `
+		update Users set TOTPEnabled = false, TOTPSecret = '', LastModified = $1
+		where ID = $2;`
+	if _, err := s.db.Exec(s.ctx, sql, time.Now(), user.ID); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't disable two factor authentication"})
+		return
+	}
+
+	sql = "delete from RecoveryCodes where UserID = $1;"
+	if _, err := s.db.Exec(s.ctx, sql, user.ID); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't delete recovery codes"})
+		return
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
+
+// second step of logging in, exchanges the challenge from Login for a jwt
+func (s *Server) LoginTOTP(c *gin.Context) {
+	var req TOTPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, err := verifyTOTPChallenge(s, req.Challenge)
+	if err != nil {
+		c.JSON(StatusUnauthorized, gin.H{"error": "Invalid challenge"})
+		return
+	}
+
+	wait, err := s.accountLimiter.Take(fmt.Sprintf("totp:%d", userID))
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't check rate limit"})
+		return
+	}
+	if wait > 0 {
+		tooManyRequests(c, wait)
+		return
+	}
+
+	user, err := getUser(s, "ID", userID)
+	if err != nil || user == nil || !user.TOTPEnabled {
+		c.JSON(StatusUnauthorized, gin.H{"error": "Invalid challenge"})
+		return
+	}
+
+	ok, err := verifySecondFactor(s, user, req.Code)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't verify code"})
+		return
+	}
+	if !ok {
+		c.JSON(StatusBadRequest, gin.H{"error": "Wrong code"})
+		return
+	}
+
+	tokens, err := startSession(s, user.ID, c.Request.UserAgent())
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't create the jwt"})
+		return
+	}
+
+	c.JSON(StatusOK, tokens)
+}
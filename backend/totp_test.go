@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// the SHA1 test vectors from RFC 6238, cut down to 6 digits
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		if code := totpCode(secret, test.time/totpPeriod); code != test.code {
+			t.Errorf("%d: got %s, want %s", test.time, code, test.code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stay clear of the next time step for the rest of the test
+	if totpPeriod-time.Now().Unix()%totpPeriod < 2 {
+		time.Sleep(2 * time.Second)
+	}
+	now := time.Now().Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		step     int64
+		ok       bool
+	}{
+		{"current", secret, totpCode(key, now), 0, now, true},
+		{"previous", secret, totpCode(key, now-1), 0, now - 1, true},
+		{"next", secret, totpCode(key, now+1), 0, now + 1, true},
+		{"lowercase secret", strings.ToLower(secret), totpCode(key, now), 0, now, true},
+		{"too old", secret, totpCode(key, now-3), 0, 0, false},
+		{"too new", secret, totpCode(key, now+3), 0, 0, false},
+		{"already used", secret, totpCode(key, now), now, 0, false},
+		{"after a later one", secret, totpCode(key, now-1), now, 0, false},
+		{"too short", secret, totpCode(key, now)[1:], 0, 0, false},
+		{"too long", secret, totpCode(key, now) + "0", 0, 0, false},
+		{"bad secret", "not base32!", totpCode(key, now), 0, 0, false},
+	}
+
+	for _, test := range tests {
+		step, ok := verifyTOTP(test.secret, test.code, test.lastStep)
+		if step != test.step || ok != test.ok {
+			t.Errorf("%s: got step %d %v, want %d %v", test.name, step, ok, test.step, test.ok)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// a unit food can be measured in. mass units convert straight to grams,
+// volume units need the food's density
+type Unit struct {
+	Kind   string // "mass" or "volume"
+	Factor float64
+}
+
+// factors are in grams for mass and milliliters for volume.
+// household measures use the us customary sizes
+var units = map[string]Unit{
+	"mg": {"mass", 0.001},
+	"g":  {"mass", 1},
+	"kg": {"mass", 1000},
+	"oz": {"mass", 28.349523125},
+	"lb": {"mass", 453.59237},
+
+	"ml":     {"volume", 1},
+	"cl":     {"volume", 10},
+	"dl":     {"volume", 100},
+	"l":      {"volume", 1000},
+	"tsp":    {"volume", 4.92892159375},
+	"tbsp":   {"volume", 14.78676478125},
+	"fl oz":  {"volume", 29.5735295625},
+	"cup":    {"volume", 236.5882365},
+	"pint":   {"volume", 473.176473},
+	"quart":  {"volume", 946.352946},
+	"gallon": {"volume", 3785.411784},
+}
+
+var unitAliases = map[string]string{
+	"milligram": "mg", "milligrams": "mg",
+	"gram": "g", "grams": "g", "gr": "g",
+	"kilogram": "kg", "kilograms": "kg", "kgs": "kg",
+	"ounce": "oz", "ounces": "oz",
+	"pound": "lb", "pounds": "lb", "lbs": "lb",
+	"milliliter": "ml", "milliliters": "ml", "millilitre": "ml", "millilitres": "ml",
+	"centiliter": "cl", "centiliters": "cl",
+	"deciliter": "dl", "deciliters": "dl",
+	"liter": "l", "liters": "l", "litre": "l", "litres": "l",
+	"teaspoon": "tsp", "teaspoons": "tsp", "tsps": "tsp",
+	"tablespoon": "tbsp", "tablespoons": "tbsp", "tbsps": "tbsp", "tbs": "tbsp",
+	"fluid ounce": "fl oz", "fluid ounces": "fl oz", "floz": "fl oz", "fl. oz": "fl oz",
+	"cups": "cup", "c": "cup",
+	"pints": "pint", "pt": "pint",
+	"quarts": "quart", "qt": "quart",
+	"gallons": "gallon", "gal": "gallon",
+}
+
+// lowercase the unit and turn aliases like "grams" into "g".
+// units that aren't in the registry, like "slice", are kept as they are
+func normalizeUnit(unit string) string {
+	unit = strings.Join(strings.Fields(strings.ToLower(unit)), " ")
+	if alias, exists := unitAliases[unit]; exists {
+		return alias
+	}
+	return unit
+}
+
+// what's needed to convert amounts of a specific food to grams
+type FoodUnits struct {
+	Density  float64            // g per ml, 0 when unknown
+	Portions map[string]float64 // food specific units, like "slice", in grams
+}
+
+var errUnconvertible = errors.New("unconvertible unit")
+
+// portions come first, since a cup of flour is better measured than
+// estimated from its density
+func (f FoodUnits) toGrams(amount float64, unit string) (float64, error) {
+	unit = normalizeUnit(unit)
+	for _, portion := range []string{unit, strings.TrimSuffix(unit, "s")} {
+		if grams, exists := f.Portions[portion]; exists {
+			return amount * grams, nil
+		}
+	}
+
+	u, exists := units[unit]
+	if exists && u.Kind == "mass" {
+		return amount * u.Factor, nil
+	}
+	if exists && u.Kind == "volume" && f.Density > 0 {
+		return amount * u.Factor * f.Density, nil
+	}
+	return 0, fmt.Errorf("%w %s", errUnconvertible, unit)
+}
+
+// how much of the food a meal has. servings are optional,
+// leaving them out means one
+func (f FoodUnits) servingGrams(servings, size float64, unit string) (float64, error) {
+	if servings == 0 {
+		servings = 1
+	}
+	return f.toGrams(servings*size, unit)
+}
+
+// food id -> its units
+func getFoodUnits(s *Server, foodIDs []uint) (map[uint]FoodUnits, error) {
+	type foodUnits struct {
+		ID uint
+		FoodUnits
+	}
+	scanUnits := func(rows pgx.Rows) (foodUnits, error) {
+		var f foodUnits
+		err := rows.Scan(&f.ID, &f.Density, &f.Portions)
+		return f, err
+	}
+
+	sql := `
+		select ID, Density, coalesce((select jsonb_object_agg(Unit, Grams)
+		       from FoodPortions where FoodID = Foods.ID), '{}')
+		from Foods where ID = any($1);`
+	rows, err := fetchRows(s, sql, scanUnits, foodIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	foods := map[uint]FoodUnits{}
+	for _, f := range rows {
+		foods[f.ID] = f.FoodUnits
+	}
+	return foods, nil
+}
+
+// like getFoodUnits, but leaves out foods the user can't see, so
+// that they can't log someone else's private food by its id
+func getVisibleFoodUnits(s *Server, foodIDs []uint, userID uint) (map[uint]FoodUnits, error) {
+	sql := fmt.Sprintf("select ID from Foods where ID = any($1) and %s;", visibleFoods(2))
+	visible, err := fetchRows(s, sql, func(rows pgx.Rows) (uint, error) {
+		var id uint
+		err := rows.Scan(&id)
+		return id, err
+	}, foodIDs, userID)
+	if err != nil {
+		return nil, err
+	}
+	return getFoodUnits(s, visible)
+}
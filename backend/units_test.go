@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestToGrams(t *testing.T) {
+	milk := FoodUnits{Density: 1.03}
+	bread := FoodUnits{Portions: map[string]float64{"slice": 30}}
+	flour := FoodUnits{Density: 0.53, Portions: map[string]float64{"cup": 125}}
+
+	tests := []struct {
+		name   string
+		food   FoodUnits
+		amount float64
+		unit   string
+		grams  float64
+		ok     bool
+	}{
+		{"grams", FoodUnits{}, 50, "g", 50, true},
+		{"alias", FoodUnits{}, 2, " Kilograms ", 2000, true},
+		{"ounces", FoodUnits{}, 1, "oz", 28.349523125, true},
+		{"volume with density", milk, 250, "ml", 257.5, true},
+		{"volume alias", milk, 1, "cups", 236.5882365 * 1.03, true},
+		{"volume without density", bread, 1, "cup", 0, false},
+		{"portion", bread, 2, "slice", 60, true},
+		{"plural portion", bread, 2, "Slices", 60, true},
+		{"portion over density", flour, 2, "cup", 250, true},
+		{"unknown portion", bread, 1, "loaf", 0, false},
+		{"unknown unit", FoodUnits{}, 1, "handful", 0, false},
+	}
+
+	for _, test := range tests {
+		grams, err := test.food.toGrams(test.amount, test.unit)
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !test.ok && !errors.Is(err, errUnconvertible) {
+			t.Errorf("%s: got %v, want an unconvertible unit", test.name, err)
+		} else if !closeTo(grams, test.grams) {
+			t.Errorf("%s: got %v g, want %v", test.name, grams, test.grams)
+		}
+	}
+}
+
+func TestServingGrams(t *testing.T) {
+	bread := FoodUnits{Portions: map[string]float64{"slice": 30}}
+	tests := []struct {
+		servings, size float64
+		grams          float64
+	}{
+		{0, 1, 30}, // leaving servings out means one
+		{1, 1, 30},
+		{2, 1, 60},
+		{0.5, 2, 30},
+	}
+
+	for _, test := range tests {
+		grams, err := bread.servingGrams(test.servings, test.size, "slice")
+		if err != nil || !closeTo(grams, test.grams) {
+			t.Errorf("%v servings of %v: got %v %v, want %v",
+				test.servings, test.size, grams, err, test.grams)
+		}
+	}
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
-	"os"
+	"log"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -12,12 +12,17 @@ import (
 
 // data models
 type User struct {
-	ID       uint   `json:"-"`
-	Email    string `json:"-"`
-	Password string `json:"-"`
+	ID            uint   `json:"-"`
+	Email         string `json:"-"`
+	Password      string `json:"-"`
+	EmailVerified bool   `json:"emailVerified"`
 
-	ScheuledMeals []string `json:"-"`
-	UseImperial   bool     `json:"useImperial"`
+	TOTPEnabled  bool   `json:"totpEnabled"`
+	TOTPSecret   string `json:"-"`
+	TOTPLastStep int64  `json:"-"`
+
+	ScheduledMeals []string `json:"-"`
+	UseImperial    bool     `json:"useImperial"`
 
 	Workouts   []Workout      `json:"workouts"`
 	PeriodDays []Record       `json:"periodDays"`
@@ -27,12 +32,14 @@ type User struct {
 
 func getUser(s *Server, by string, value any) (*User, error) {
 	sql := fmt.Sprintf(`
-		select ID, Email, Password, UseImperial, ScheduledMeals from Users
+		select ID, Email, Password, EmailVerified, TOTPEnabled, TOTPSecret,
+		TOTPLastStep, UseImperial, ScheduledMeals from Users
 		where %s = $1 and Deleted = false`, by)
 
 	var user User
 	err := s.db.QueryRow(s.ctx, sql, value).Scan(&user.ID, &user.Email,
-		&user.Password, &user.UseImperial, &user.ScheuledMeals)
+		&user.Password, &user.EmailVerified, &user.TOTPEnabled, &user.TOTPSecret,
+		&user.TOTPLastStep, &user.UseImperial, &user.ScheduledMeals)
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, nil
 	} else if err != nil {
@@ -46,10 +53,11 @@ func createUser(s *Server, email string, password string) (uint, error) {
 	var userId uint
 	sql1 := `
 		insert into Users
-		(LastModified, Deleted, Email, Password, UseImperial)
-		values ($1, $2, $3, $4, $5) returning ID;
+		(LastModified, Deleted, Email, Password, UseImperial, ScheduledMeals)
+		values ($1, $2, $3, $4, $5, $6) returning ID;
 	`
-	err := s.db.QueryRow(s.ctx, sql1, time.Now(), false, email, password, true).Scan(&userId)
+	err := s.db.QueryRow(s.ctx, sql1, time.Now(), false, email,
+		password, true, defaultScheduledMeals).Scan(&userId)
 	if err != nil {
 		return 0, err
 	}
@@ -57,6 +65,39 @@ func createUser(s *Server, email string, password string) (uint, error) {
 	return userId, err
 }
 
+func updatePassword(s *Server, userID uint, password string) error {
+	hash, err := hashPassword(password, s.config.Argon2)
+	if err != nil {
+		return err
+	}
+
+	sql := "update Users set Password = $1, LastModified = $2 where ID = $3;"
+	_, err = s.db.Exec(s.ctx, sql, hash, time.Now(), userID)
+	return err
+}
+
+// start a session for a user who has proven who they are, or
+// ask for their second factor first if they've enabled it
+func issueTokens(c *gin.Context, s *Server, user *User) {
+	if user.TOTPEnabled {
+		challenge, err := createTOTPChallenge(s, user.ID)
+		if err != nil {
+			c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't create the challenge"})
+			return
+		}
+		c.JSON(StatusOK, gin.H{"totpRequired": true, "challenge": challenge})
+		return
+	}
+
+	tokens, err := startSession(s, user.ID, c.Request.UserAgent())
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't create the jwt"})
+		return
+	}
+
+	c.JSON(StatusOK, tokens)
+}
+
 // api endpoints
 type AuthRequest struct {
 	Email    string `json:"email"`
@@ -70,35 +111,82 @@ func (s *Server) Login(c *gin.Context) {
 		return
 	}
 
-	user, err := getUser(s, "Email", req.Email)
+	wait, err := s.accountLimiter.Take(normalizeEmail(req.Email))
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't check rate limit"})
+		return
+	}
+	if wait > 0 {
+		tooManyRequests(c, wait)
+		return
+	}
+
+	locked, err := loginLockedFor(s, req.Email)
 	if err != nil {
 		c.JSON(StatusInternalServerError, gin.H{"error": "Coudln't query database"})
 		return
 	}
+	if locked > 0 {
+		tooManyRequests(c, locked)
+		return
+	}
 
-	if user == nil {
-		c.JSON(StatusBadRequest, gin.H{"error": "Account not found"})
+	user, err := getUser(s, "Email", req.Email)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Coudln't query database"})
 		return
 	}
 
-	correctPassword, err := verifyPassword(req.Password, user.Password)
+	// still hash the password when the account doesn't exist,
+	// so the response time doesn't give that away either
+	hash := s.dummyHash
+	if user != nil && user.Password != "" { // users from an identity provider don't have one
+		hash = user.Password
+	}
+
+	correctPassword, err := verifyPassword(req.Password, hash)
 	if err != nil {
 		c.JSON(StatusInternalServerError, gin.H{"error": "Coudln't verify password"})
 		return
 	}
 
-	if !correctPassword {
-		c.JSON(StatusBadRequest, gin.H{"error": "Wrong password"})
+	if user == nil || user.Password == "" || !correctPassword {
+		if err := recordLoginFailure(s, req.Email); err != nil {
+			c.JSON(StatusInternalServerError, gin.H{"error": "Coudln't query database"})
+			return
+		}
+		c.JSON(StatusBadRequest, gin.H{"error": "Wrong email or password"})
 		return
 	}
 
-	token, err := createToken(fmt.Sprintf("%d", user.ID), os.Getenv("JWT_SECRET"))
-	if err != nil {
-		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't create the jwt"})
+	if err := clearLoginFailures(s, req.Email); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Coudln't query database"})
 		return
 	}
 
-	c.JSON(StatusOK, gin.H{"jwt": token})
+	// upgrade hashes made before the cost parameters were raised,
+	// now that we have the plaintext password to do it with
+	if needsRehash(user.Password, s.config.Argon2) {
+		if err := updatePassword(s, user.ID, req.Password); err != nil {
+			log.Printf("couldn't rehash password: %v", err)
+		}
+	}
+
+	if s.config.RequireVerifiedEmail && !user.EmailVerified {
+		c.JSON(StatusForbidden, gin.H{"error": "Email not verified"})
+		return
+	}
+
+	issueTokens(c, s, user)
+}
+
+// tell the owner of an existing account that someone tried to sign up with it
+func sendSignupNotice(s *Server, email string) {
+	body := "Someone tried to create an aro account with your email address.\n\n" +
+		"If this was you, log in or reset your password instead.\n"
+	if err := s.mailer.Send(email, "Your aro account", body); err != nil {
+		log.Printf("couldn't send signup notice: %v", err)
+	}
 }
 
 func (s *Server) Signup(c *gin.Context) {
@@ -108,36 +196,51 @@ func (s *Server) Signup(c *gin.Context) {
 		return
 	}
 
-	user, err := getUser(s, "Email", req.Email)
-	if err != nil {
-		c.JSON(StatusInternalServerError, gin.H{"error": "Coudln't query database"})
+	if !validEmail(req.Email) {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid email"})
 		return
 	}
 
-	if user != nil {
-		c.JSON(StatusBadRequest, gin.H{"error": "Account already exists"})
+	// hashed up front so that taken emails don't answer any faster
+	password, err := hashPassword(req.Password, s.config.Argon2)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Error hashing password"})
 		return
 	}
 
-	password, err := hashPassword(req.Password)
+	user, err := getUser(s, "Email", req.Email)
 	if err != nil {
-		c.JSON(StatusInternalServerError, gin.H{"error": "Error hashing password"})
+		c.JSON(StatusInternalServerError, gin.H{"error": "Coudln't query database"})
+		return
+	}
+
+	// signing up responds the same way whether or not the email is taken, so
+	// it can't reveal who has an account. the owner is told about the attempt
+	// instead, and new users log in once they're allowed to
+	response := gin.H{"verificationRequired": s.config.RequireVerifiedEmail}
+	if user != nil {
+		sendSignupNotice(s, user.Email)
+		c.JSON(StatusOK, response)
 		return
 	}
 
 	userID, err := createUser(s, req.Email, password)
-	if err != nil {
+	if isUniqueViolation(err) { // same email with different casing
+		sendSignupNotice(s, req.Email)
+		c.JSON(StatusOK, response)
+		return
+	} else if err != nil {
 		c.JSON(StatusInternalServerError, gin.H{"error": "Error creating user"})
 		return
 	}
 
-	token, err := createToken(fmt.Sprintf("%d", userID), os.Getenv("JWT_SECRET"))
-	if err != nil {
-		c.JSON(StatusInternalServerError, gin.H{"error": "Coudln't create the JWT"})
-		return
+	// the account is usable either way, the user can ask for another email later
+	newUser := &User{ID: userID, Email: req.Email}
+	if err := sendVerificationEmail(s, newUser); err != nil {
+		log.Printf("couldn't send verification email: %v", err)
 	}
 
-	c.JSON(StatusOK, gin.H{"jwt": token})
+	c.JSON(StatusOK, response)
 }
 
 func (s *Server) UpdateSettings(c *gin.Context) {
@@ -155,26 +258,131 @@ func (s *Server) UpdateSettings(c *gin.Context) {
 	c.JSON(StatusOK, gin.H{})
 }
 
-func (s *Server) DeleteUser(c *gin.Context) {
+type ChangeRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	Email           string `json:"email,omitempty"`
+	Password        string `json:"password,omitempty"`
+}
+
+func (s *Server) ChangeEmail(c *gin.Context) {
+	var req ChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := c.MustGet("user").(*User)
+
+	if user.Password == "" {
+		c.JSON(StatusBadRequest, gin.H{"error": "Set a password first"})
+		return
+	}
+
+	correctPassword, err := verifyPassword(req.CurrentPassword, user.Password)
+	if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Coudln't verify password"})
+		return
+	}
+	if !correctPassword {
+		c.JSON(StatusBadRequest, gin.H{"error": "Wrong password"})
+		return
+	}
+
+	if !validEmail(req.Email) {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid email"})
+		return
+	}
+
+	// the new address still has to be verified
+	sql := `
+		update Users set Email = $1, EmailVerified = false, LastModified = $2
+		where ID = $3;`
+	_, err = s.db.Exec(s.ctx, sql, req.Email, time.Now(), user.ID)
+	if isUniqueViolation(err) {
+		c.JSON(StatusBadRequest, gin.H{"error": "Email already in use"})
+		return
+	} else if err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't change email"})
+		return
+	}
+
+	body := fmt.Sprintf("The email address on your aro account was changed to %s.\n\n"+
+		"If this wasn't you, reset your password right away.\n", req.Email)
+	if err := s.mailer.Send(user.Email, "Your email was changed", body); err != nil {
+		log.Printf("couldn't send email change notice: %v", err)
+	}
+
+	if err := sendVerificationEmail(s, &User{ID: user.ID, Email: req.Email}); err != nil {
+		log.Printf("couldn't send verification email: %v", err)
+	}
+
+	c.JSON(StatusOK, gin.H{})
+}
+
+func (s *Server) ChangePassword(c *gin.Context) {
+	var req ChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	user := c.MustGet("user").(*User)
+	sessionID := c.MustGet("sessionID").(uint)
 
-	sql := "update Users set Deleted = true where ID = $1;"
-	_, err := s.db.Exec(s.ctx, sql, user.ID)
+	if req.Password == "" {
+		c.JSON(StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	// users who signed up through an identity provider don't have a password
+	// to confirm, so a token alone isn't enough. they set their first one
+	// through a reset link, which proves they still own the inbox
+	if user.Password == "" {
+		if err := sendPasswordResetEmail(s, user); err != nil {
+			c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't send email"})
+			return
+		}
+		c.JSON(StatusOK, gin.H{"emailSent": true})
+		return
+	}
+
+	correctPassword, err := verifyPassword(req.CurrentPassword, user.Password)
 	if err != nil {
-		c.JSON(StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(StatusInternalServerError, gin.H{"error": "Coudln't verify password"})
+		return
+	}
+	if !correctPassword {
+		c.JSON(StatusBadRequest, gin.H{"error": "Wrong password"})
+		return
+	}
+
+	if err := updatePassword(s, user.ID, req.Password); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't change password"})
 		return
 	}
 
-	if err := deleteRecords(s, user.ID); err != nil {
-		c.JSON(StatusInternalServerError, gin.H{"error": err.Error()})
+	// log out every other device and api token, along with any pending password resets
+	if err := revokeSessions(s, user.ID, sessionID); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't end sessions"})
+		return
+	}
+	if err := revokeAPITokens(s, user.ID); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't revoke tokens"})
 		return
 	}
 
-	if err := deleteWorkouts(s, user.ID); err != nil {
-		c.JSON(StatusInternalServerError, gin.H{"error": err.Error()})
+	sql := `
+		update EmailTokens set Used = true, LastModified = $1
+		where UserID = $2 and Purpose = $3 and Used = false;`
+	if _, err := s.db.Exec(s.ctx, sql, time.Now(), user.ID, resetPasswordPurpose); err != nil {
+		c.JSON(StatusInternalServerError, gin.H{"error": "Couldn't change password"})
 		return
 	}
 
+	body := "The password on your aro account was changed.\n\n" +
+		"If this wasn't you, reset your password right away.\n"
+	if err := s.mailer.Send(user.Email, "Your password was changed", body); err != nil {
+		log.Printf("couldn't send password change notice: %v", err)
+	}
+
 	c.JSON(StatusOK, gin.H{})
 }
 
@@ -197,6 +405,20 @@ func (s *Server) UserInfo(c *gin.Context) {
 		return
 	}
 
+	// api tokens only get the data their scopes allow
+	requested := map[string]bool{
+		"workouts:read": req.GetWorkouts || req.GetTemplates,
+		"period:read":   req.GetPeriodDays,
+		"weight:read":   req.GetWeighIns,
+		"meals:read":    req.GetFoodLogs,
+	}
+	for scope, needed := range requested {
+		if needed && !hasScope(c, scope) {
+			c.JSON(StatusForbidden, gin.H{"error": "Missing scope " + scope})
+			return
+		}
+	}
+
 	user := c.MustGet("user").(*User)
 	options := FetchOptions{
 		page: req.Page, userID: user.ID, limit: 10,
@@ -204,7 +426,10 @@ func (s *Server) UserInfo(c *gin.Context) {
 	}
 
 	var templatesCount, workoutsCount int
-	info := User{UseImperial: user.UseImperial}
+	info := User{
+		UseImperial: user.UseImperial, EmailVerified: user.EmailVerified,
+		TOTPEnabled: user.TOTPEnabled,
+	}
 
 	if req.GetWorkouts {
 		workouts, err := getWorkouts(s, false, options)
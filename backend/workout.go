@@ -82,29 +82,6 @@ func deleteWorkout(s *Server, userId uint, workoutId uint) error {
 	return tx.Commit(s.ctx)
 }
 
-func deleteWorkouts(s *Server, userID uint) error {
-	sql := `update Workouts set Deleted = true, LastModified = $1 where UserID = $2 returning ID;`
-	rows, err := s.db.Query(s.ctx, sql, time.Now(), userID)
-	if err != nil {
-		return err
-	}
-
-	for rows.Next() {
-		var workoutID uint
-		if err := rows.Scan(&workoutID); err != nil {
-			return err
-		}
-
-		sql = `update Exercises set Deleted = true, LastModified = $1 where WorkoutID = $2;`
-		_, err := s.db.Exec(s.ctx, sql, time.Now(), workoutID)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
 func getWorkouts(s *Server, isTemplate bool, options FetchOptions) ([]Workout, error) {
 	scanWorkout := func(rows pgx.Rows) (Workout, error) {
 		var w Workout
@@ -57,18 +57,18 @@ export default function FoodInfo() {
       }
 
       <View>
-        <Text className="text-lg font-bold">Calories {food.calories}</Text>
-        <Text className="text-base font-bold">Fat {food.fat}</Text>
-        <Text className="text-base font-bold">Carboydrate {food.carbohydrates}</Text>
-        <Text className="text-base font-bold">Protein {food.protein}</Text>
-        <Text className="text-base font-bold">Cholesterol {food.cholesterol}</Text>
-        <Text className="text-base font-bold">Sodium {food.sodium}</Text>
+        <Text className="text-lg font-bold">Calories {food.nutrients.calories ?? 0}</Text>
+        <Text className="text-base font-bold">Fat {food.nutrients.fat ?? 0}</Text>
+        <Text className="text-base font-bold">Carboydrate {food.nutrients.carbohydrates ?? 0}</Text>
+        <Text className="text-base font-bold">Protein {food.nutrients.protein ?? 0}</Text>
+        <Text className="text-base font-bold">Cholesterol {food.nutrients.cholesterol ?? 0}</Text>
+        <Text className="text-base font-bold">Sodium {food.nutrients.sodium ?? 0}</Text>
 
         <View className="border-b-2 border-grey-500 w-[10%]"></View>
 
-        <Text className="text-base font-bold">Calcium {food.calcium}</Text>
-        <Text className="text-base font-bold">Magnesium {food.magnesium}</Text>
-        <Text className="text-base font-bold">Potassium {food.potassium}</Text>
+        <Text className="text-base font-bold">Calcium {food.nutrients.calcium ?? 0}</Text>
+        <Text className="text-base font-bold">Magnesium {food.nutrients.magnesium ?? 0}</Text>
+        <Text className="text-base font-bold">Potassium {food.nutrients.potassium ?? 0}</Text>
       </View>
     </Container>
   )
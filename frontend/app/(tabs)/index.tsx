@@ -17,7 +17,7 @@ export default function Index() {
   const [email, setEmail] = useState("");
   const [password, setPassword] = useState("");
 
-  const syncUserData = async (jwt: string) => {
+  const syncUserData = async () => {
     const payload = {
       page: 0,
       getSettings: true,
@@ -28,8 +28,8 @@ export default function Index() {
       unixTimestamp: store.lastUpdateTime,
     };
     try {
-      const json = await request("POST", "/auth/user", payload, jwt);
-       store.updateUserData(jwt, json);
+      const json = await request("POST", "/auth/user", payload, useStore.getState().jwt);
+      store.updateUserData(json);
       router.replace("/food");
     } catch (err: any) {
       console.log("ERROR!", err);
@@ -42,7 +42,7 @@ export default function Index() {
 
   useEffect(() => {
     if (store.jwt.length > 0)
-      syncUserData(store.jwt);
+      syncUserData();
   }, []);
 
   const toggle = () => {
@@ -78,11 +78,18 @@ export default function Index() {
       password,
     );
     const body = { email, password: passwordHash };
-    const endpoint = isLogin ? "/login" : "/signup";
 
     try {
-      const json = await request("POST", endpoint, body);
-      syncUserData(json.jwt);
+      if (!isLogin) {
+        const json = await request("POST", "/signup", body);
+        if (json.verificationRequired) {
+          setErrMsg("Check your email to verify your account, then log in");
+          return;
+        }
+      }
+      const json = await request("POST", "/login", body);
+      store.setTokens(json.jwt, json.refreshToken);
+      syncUserData();
     } catch (err: any) {
       setErrMsg(err.message);
     }
@@ -65,7 +65,7 @@ export function Meal({ meal, isResult }: MealProps) {
           <Text className={`text-base ${root ? "font-bold" : ""}`}>{name}</Text>
           {!isParent &&
             <Text className="text-sm font-grey-500">
-              {food.calories} calories
+              {food.nutrients.calories ?? 0} calories
             </Text>}
         </View>
 
@@ -28,15 +28,8 @@ export interface Food {
   servingSizes: number[];
   servingSizeUnits: string[];
 
-  calories: number;
-  protein: number;
-  carbohydrates: number;
-  fat: number;
-  cholesterol: number;
-  calcium: number;
-  sodium: number;
-  magnesium: number;
-  potassium: number;
+  // nutrient code -> amount per 1 g
+  nutrients: Record<string, number>;
 }
 
 export interface MealNode {
@@ -71,7 +64,8 @@ type Data = {
 }
 
 export interface AppState {
-  jwt: string;
+  jwt: string; // short lived, renewed with the refresh token
+  refreshToken: string;
   useImperial: boolean;
   lastUpdateTime: number;
   data: Data;
@@ -79,7 +73,8 @@ export interface AppState {
   // TODO: daily meals should be paginated...
   dailyMeals: Record<string, number[]>; // map date to list of meal ids
 
-  updateUserData: (jwt: string, json: any) => void;
+  setTokens: (jwt: string, refreshToken: string) => void;
+  updateUserData: (json: any) => void;
   paginate: (dataType: DataKey, more: boolean) => void;
 
   upsertWorkout: (w: WorkoutInfo) => void;
@@ -117,6 +112,7 @@ function updateExercises(state: AppState, workoutId: number,
 // remember, set() *merges* state
 const createAppStore: StateCreator<AppState> = (set, _get) => ({
   jwt: "",
+  refreshToken: "",
   useImperial: true,
   lastUpdateTime: 0,
   data: Object.fromEntries(keys.map(k =>
@@ -127,7 +123,9 @@ const createAppStore: StateCreator<AppState> = (set, _get) => ({
   updateSettings: (userData) =>
     set((state: AppState) => ({ ...state, ...userData })),
 
-  updateUserData: (jwt, json) =>
+  setTokens: (jwt, refreshToken) => set({ jwt, refreshToken }),
+
+  updateUserData: (json) =>
     set((state: AppState) => {
       let data = JSON.parse(JSON.stringify(state.data)); // clone
 
@@ -154,7 +152,7 @@ const createAppStore: StateCreator<AppState> = (set, _get) => ({
       }
 
       return {
-        jwt, ressources: data, lastUpdateTime: Date.now(),
+        ressources: data, lastUpdateTime: Date.now(),
         useImperial: json.user.settings.useImperial,
       };
     }),
@@ -1,5 +1,7 @@
 
-export async function request(method: string, endpoint: string, body?: object, jwt?: string) {
+import { resetStore, useStore } from "@/lib/state";
+
+async function send(method: string, endpoint: string, body?: object, jwt?: string) {
   let headers: HeadersInit = { "Content-Type": "application/json" };
   if (jwt) headers["Authorization"] = `Bearer ${jwt}`;
   let payload: RequestInit = { method, headers };
@@ -8,6 +10,47 @@ export async function request(method: string, endpoint: string, body?: object, j
   const url = `${process.env.EXPO_PUBLIC_API_URL}:8080${endpoint}`;
   const response = await fetch(url, payload);
   const data = await response.json();
+  return { response, data };
+}
+
+// trade the refresh token for a new pair, returning the new jwt.
+// the session is cleared when that fails, which brings up the login screen.
+// requests that fail at the same time share one refresh, since each
+// refresh token can only be used once
+let pendingRefresh: Promise<string | null> | null = null;
+
+function refreshTokens(): Promise<string | null> {
+  if (!pendingRefresh)
+    pendingRefresh = renewTokens().finally(() => { pendingRefresh = null; });
+  return pendingRefresh;
+}
+
+async function renewTokens(): Promise<string | null> {
+  const { refreshToken, setTokens } = useStore.getState();
+  if (refreshToken.length > 0) {
+    try {
+      const { response, data } = await send("POST", "/token/refresh", { refreshToken });
+      if (response.ok) {
+        setTokens(data.jwt, data.refreshToken);
+        return data.jwt;
+      }
+    } catch (err: any) {
+      console.log("ERROR!", err);
+    }
+  }
+  await resetStore();
+  return null;
+}
+
+// jwts are short lived, so an expired one is refreshed and the request retried once
+export async function request(method: string, endpoint: string, body?: object, jwt?: string) {
+  let { response, data } = await send(method, endpoint, body, jwt);
+
+  if (response.status == 401 && jwt) {
+    const renewed = await refreshTokens();
+    if (!renewed) throw new Error("Session expired, log in again");
+    ({ response, data } = await send(method, endpoint, body, renewed));
+  }
 
   if (!response.ok) throw new Error(data.error ?? "Unknown error");
   return data;